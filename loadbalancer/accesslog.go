@@ -0,0 +1,140 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	AccessLogStructured = "structured"
+	AccessLogCommon     = "common"
+	AccessLogCombined   = "combined"
+)
+
+type AccessLogConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Format is "structured" to log through slog, or "common"/"combined" to
+	// write Apache-style lines to stdout.
+	Format string `yaml:"format"`
+}
+
+func (c AccessLogConfig) validate() error {
+	switch c.Format {
+	case AccessLogStructured, AccessLogCommon, AccessLogCombined:
+		return nil
+	}
+	return fmt.Errorf("unknown format %q, want %s, %s or %s", c.Format, AccessLogStructured, AccessLogCommon, AccessLogCombined)
+}
+
+type requestInfoKey struct{}
+
+// requestInfo carries details about how a request was handled from the
+// proxying code back to the access log.
+type requestInfo struct {
+	backend string
+}
+
+func requestInfoFrom(r *http.Request) *requestInfo {
+	info, _ := r.Context().Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// statusRecorder captures the status code and body size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Hijack hands over the connection for a protocol upgrade. The proxy then
+// writes the 101 response straight to the connection, so it is recorded
+// here.
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// accessLog logs one line per request once next has finished with it.
+func accessLog(next http.Handler, format string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &requestInfo{}
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		duration := time.Since(start)
+		switch format {
+		case AccessLogCommon, AccessLogCombined:
+			fmt.Fprintln(os.Stdout, formatAccessLine(format, r, rec, info, start, duration))
+		default:
+			slog.Info("access",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"client_ip", clientIP(r, false),
+				"backend", info.backend,
+				"request_id", requestIDFrom(r),
+				"status", rec.status,
+				"bytes", rec.bytes,
+				"duration_ms", float64(duration.Microseconds())/1000,
+			)
+		}
+	})
+}
+
+// formatAccessLine renders the Common or Combined Log Format, followed by the
+// backend, the request duration and the request ID, if any.
+func formatAccessLine(format string, r *http.Request, rec *statusRecorder, info *requestInfo, start time.Time, duration time.Duration) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s - - [%s] %q %d %d",
+		clientIP(r, false),
+		start.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method+" "+r.URL.RequestURI()+" "+r.Proto,
+		rec.status,
+		rec.bytes,
+	)
+	if format == AccessLogCombined {
+		fmt.Fprintf(&b, " %q %q", r.Referer(), r.UserAgent())
+	}
+	backend := info.backend
+	if backend == "" {
+		backend = "-"
+	}
+	fmt.Fprintf(&b, " %s %.3f", backend, duration.Seconds())
+	if id := requestIDFrom(r); id != "" {
+		fmt.Fprintf(&b, " %s", id)
+	}
+	return b.String()
+}
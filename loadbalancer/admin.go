@@ -0,0 +1,453 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type backendStatus struct {
+	Pool        string            `json:"pool"`
+	URL         string            `json:"url"`
+	Alive       bool              `json:"alive"`
+	Draining    bool              `json:"draining"`
+	Weight      int               `json:"weight"`
+	ActiveConns int64             `json:"active_connections"`
+	MaxConns    int64             `json:"max_connections,omitempty"`
+	Priority    int               `json:"priority"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	// LastCheck is nil until the backend has been health checked.
+	LastCheck *CheckInfo `json:"last_check,omitempty"`
+}
+
+func statusOf(b *Backend) backendStatus {
+	return backendStatus{
+		Pool:        b.pool.name,
+		URL:         b.url.String(),
+		Alive:       b.IsAlive(),
+		Draining:    b.IsDraining(),
+		Weight:      b.Weight(),
+		ActiveConns: b.ActiveConns(),
+		MaxConns:    b.MaxConns(),
+		Priority:    b.Priority(),
+		Tags:        b.Tags(),
+		LastCheck:   checkInfoOf(b.LastCheck()),
+	}
+}
+
+// statusResponse reports on the load balancer as a whole. MaxRequests is
+// zero when concurrency is not limited.
+type statusResponse struct {
+	InFlight    int64 `json:"in_flight"`
+	Queued      int64 `json:"queued"`
+	MaxRequests int   `json:"max_requests"`
+	Maintenance bool  `json:"maintenance"`
+}
+
+type maintenanceStatus struct {
+	Maintenance bool `json:"maintenance"`
+}
+
+type backendsResponse struct {
+	Backends []backendStatus `json:"backends"`
+}
+
+// newAdminHandler serves the admin API. Endpoints that act on a single pool
+// take its name from the pool query parameter and default to the router's
+// default pool.
+func newAdminHandler(router *Router, limiter *concurrencyLimiter, m *metrics, mt *maintenance, events *eventHub) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_lb/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, statusResponse{
+			InFlight:    limiter.InFlight(),
+			Queued:      limiter.Queued(),
+			MaxRequests: limiter.Limit(),
+			Maintenance: mt.on.Load(),
+		})
+	})
+	mux.HandleFunc("/_lb/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, maintenanceStatus{Maintenance: mt.on.Load()})
+		case http.MethodPost:
+			on, err := strconv.ParseBool(r.URL.Query().Get("on"))
+			if err != nil {
+				http.Error(w, "Invalid on parameter", http.StatusBadRequest)
+				return
+			}
+			if mt.on.Swap(on) != on {
+				slog.Info("maintenance mode changed", "maintenance", on)
+			}
+			writeJSON(w, http.StatusOK, maintenanceStatus{Maintenance: on})
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/_lb/backends", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			listBackends(router, w, r)
+			return
+		}
+		pool, ok := poolFromQuery(router, w, r)
+		if !ok {
+			return
+		}
+		switch r.Method {
+		case http.MethodPost:
+			addBackend(pool, w, r)
+		case http.MethodPatch:
+			setWeight(pool, w, r)
+		case http.MethodDelete:
+			if r.URL.Query().Has("drain") {
+				drainAndRemoveBackend(pool, w, r)
+				return
+			}
+			removeBackend(pool, w, r)
+		default:
+			w.Header().Set("Allow", "GET, POST, PATCH, DELETE")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/_lb/backends/drain", func(w http.ResponseWriter, r *http.Request) {
+		pool, ok := poolFromQuery(router, w, r)
+		if !ok {
+			return
+		}
+		switch r.Method {
+		case http.MethodPost:
+			setDraining(pool, w, r, true)
+		case http.MethodDelete:
+			setDraining(pool, w, r, false)
+		default:
+			w.Header().Set("Allow", "POST, DELETE")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/_lb/canary", func(w http.ResponseWriter, r *http.Request) {
+		pool, ok := poolFromQuery(router, w, r)
+		if !ok {
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			getCanary(pool, w)
+		case http.MethodPut:
+			setCanary(pool, w, r)
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	// /healthz and /readyz are for orchestrators: the first answers as long
+	// as the process serves, the second only while some backend is alive.
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !anyBackendAlive(router) {
+			http.Error(w, "No backend is alive", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/_lb/metrics/reset", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		m.resetBackends()
+		slog.Info("reset backend metrics")
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/_lb/version", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, buildVersion())
+	})
+	mux.HandleFunc("/_lb/events", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		serveEvents(events, w, r)
+	})
+	mux.Handle("/metrics", m.handler())
+	// expvar publishes the runtime's memstats and the command line.
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
+func anyBackendAlive(router *Router) bool {
+	for _, pool := range router.Pools() {
+		for _, b := range pool.Backends() {
+			if b.IsAlive() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// listBackends lists the backends of the pool named in the query, or of all
+// pools when there is none.
+func listBackends(router *Router, w http.ResponseWriter, r *http.Request) {
+	pools := router.Pools()
+	if r.URL.Query().Has("pool") {
+		pool, ok := poolFromQuery(router, w, r)
+		if !ok {
+			return
+		}
+		pools = []*ServerPool{pool}
+	}
+	resp := backendsResponse{Backends: []backendStatus{}}
+	for _, pool := range pools {
+		for _, b := range pool.Backends() {
+			resp.Backends = append(resp.Backends, statusOf(b))
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// poolFromQuery looks up the pool named by the pool query parameter, or the
+// default pool when it is absent, replying with 404 when there is no such
+// pool.
+func poolFromQuery(router *Router, w http.ResponseWriter, r *http.Request) (*ServerPool, bool) {
+	var pool *ServerPool
+	if name := r.URL.Query().Get("pool"); name != "" {
+		pool = router.Pool(name)
+	} else {
+		pool = router.DefaultPool()
+	}
+	if pool == nil {
+		http.Error(w, "Pool not found", http.StatusNotFound)
+		return nil, false
+	}
+	return pool, true
+}
+
+type addBackendRequest struct {
+	URL string `json:"url"`
+}
+
+// addBackend adds the backend in the request body to pool. It stays through
+// config reloads and discovery rounds until it is removed again, unless the
+// configuration starts listing it.
+func addBackend(pool *ServerPool, w http.ResponseWriter, r *http.Request) {
+	var req addBackendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	b, err := NewBackend(req.URL, pool)
+	if err != nil {
+		http.Error(w, "Invalid backend url", http.StatusBadRequest)
+		return
+	}
+	b.setAdminAdded(true)
+	if !pool.AddBackend(b) {
+		http.Error(w, "Backend already exists", http.StatusConflict)
+		return
+	}
+	slog.Info("added backend", "pool", pool.name, "backend", b.url.String())
+	writeJSON(w, http.StatusCreated, statusOf(b))
+}
+
+// backendURLFromQuery parses the url query parameter, replying with 400 when
+// it is missing or malformed.
+func backendURLFromQuery(w http.ResponseWriter, r *http.Request) (*url.URL, bool) {
+	u, err := parseBackendURL(r.URL.Query().Get("url"))
+	if err != nil {
+		http.Error(w, "Invalid backend url", http.StatusBadRequest)
+		return nil, false
+	}
+	return u, true
+}
+
+func removeBackend(pool *ServerPool, w http.ResponseWriter, r *http.Request) {
+	u, ok := backendURLFromQuery(w, r)
+	if !ok {
+		return
+	}
+	if !pool.RemoveBackend(u) {
+		http.Error(w, "Backend not found", http.StatusNotFound)
+		return
+	}
+	slog.Info("removed backend", "pool", pool.name, "backend", u.String())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// defaultDrainTimeout bounds a drain-then-remove that sets no timeout.
+const defaultDrainTimeout = 30 * time.Second
+
+type drainResult struct {
+	Pool    string `json:"pool"`
+	URL     string `json:"url"`
+	Drained bool   `json:"drained"`
+	Removed bool   `json:"removed"`
+}
+
+// drainAndRemoveBackend drains the backend, waits for its in-flight
+// requests, up to the timeout query parameter, and removes it. The call
+// blocks only its own request; disconnecting cancels the drain and puts the
+// backend back in rotation, as does undraining it through
+// /_lb/backends/drain.
+func drainAndRemoveBackend(pool *ServerPool, w http.ResponseWriter, r *http.Request) {
+	u, ok := backendURLFromQuery(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	if drain, err := strconv.ParseBool(q.Get("drain")); err != nil || !drain {
+		http.Error(w, "Invalid drain parameter", http.StatusBadRequest)
+		return
+	}
+	timeout := defaultDrainTimeout
+	if v := q.Get("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "Invalid timeout parameter", http.StatusBadRequest)
+			return
+		}
+		timeout = d
+	}
+
+	slog.Info("draining backend before removal", "pool", pool.name, "backend", u.String(), "timeout", timeout)
+	drained, err := pool.DrainAndRemove(r.Context(), u, timeout)
+	switch {
+	case errors.Is(err, ErrBackendNotFound):
+		http.Error(w, "Backend not found", http.StatusNotFound)
+	case errors.Is(err, ErrDrainCancelled):
+		slog.Info("drain cancelled, backend kept", "pool", pool.name, "backend", u.String())
+		http.Error(w, "Drain cancelled", http.StatusConflict)
+	case err != nil:
+		// The client went away; there is no one to reply to.
+		slog.Info("drain abandoned, backend back in rotation", "pool", pool.name, "backend", u.String(), "error", err)
+	default:
+		if drained {
+			slog.Info("removed drained backend", "pool", pool.name, "backend", u.String())
+		} else {
+			slog.Warn("drain timed out, removed backend with requests in flight", "pool", pool.name, "backend", u.String(), "timeout", timeout)
+		}
+		writeJSON(w, http.StatusOK, drainResult{Pool: pool.name, URL: u.String(), Drained: drained, Removed: true})
+	}
+}
+
+func setDraining(pool *ServerPool, w http.ResponseWriter, r *http.Request, draining bool) {
+	u, ok := backendURLFromQuery(w, r)
+	if !ok {
+		return
+	}
+	b := pool.GetBackend(u)
+	if b == nil {
+		http.Error(w, "Backend not found", http.StatusNotFound)
+		return
+	}
+	b.SetDraining(draining)
+	if draining {
+		slog.Info("draining backend", "pool", pool.name, "backend", u.String(), "status", "draining", "active_connections", b.ActiveConns())
+	} else {
+		slog.Info("backend back in rotation", "pool", pool.name, "backend", u.String())
+	}
+	writeJSON(w, http.StatusOK, statusOf(b))
+}
+
+// setWeight changes a backend's weight to the weight query parameter. The
+// weighted algorithms use it from the next request on. It holds until a
+// config reload or discovery round changes the backend's configured weight.
+func setWeight(pool *ServerPool, w http.ResponseWriter, r *http.Request) {
+	u, ok := backendURLFromQuery(w, r)
+	if !ok {
+		return
+	}
+	weight, err := strconv.Atoi(r.URL.Query().Get("weight"))
+	if err != nil || weight < 0 {
+		http.Error(w, "Invalid weight, want a non-negative integer", http.StatusBadRequest)
+		return
+	}
+	b := pool.GetBackend(u)
+	if b == nil {
+		http.Error(w, "Backend not found", http.StatusNotFound)
+		return
+	}
+	old := b.Weight()
+	b.SetWeight(weight)
+	slog.Info("backend weight changed", "pool", pool.name, "backend", u.String(), "from", old, "to", weight)
+	writeJSON(w, http.StatusOK, statusOf(b))
+}
+
+type canaryStatus struct {
+	Pool    string  `json:"pool"`
+	Canary  string  `json:"canary"`
+	Percent float64 `json:"percent"`
+}
+
+type setCanaryRequest struct {
+	Percent *float64 `json:"percent"`
+}
+
+func getCanary(pool *ServerPool, w http.ResponseWriter) {
+	sp := pool.Splitter()
+	if sp == nil {
+		http.Error(w, "Pool has no canary", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, canaryStatus{Pool: pool.name, Canary: sp.Canary().name, Percent: sp.Percent()})
+}
+
+// setCanary changes the share of traffic sent to the pool's canary. The
+// change lasts until the next config reload.
+func setCanary(pool *ServerPool, w http.ResponseWriter, r *http.Request) {
+	sp := pool.Splitter()
+	if sp == nil {
+		http.Error(w, "Pool has no canary", http.StatusNotFound)
+		return
+	}
+	var req setCanaryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Percent == nil || *req.Percent < 0 || *req.Percent > 100 {
+		http.Error(w, "percent must be between 0 and 100", http.StatusBadRequest)
+		return
+	}
+	sp.SetPercent(*req.Percent)
+	slog.Info("canary split changed", "pool", pool.name, "canary", sp.Canary().name, "percent", *req.Percent)
+	writeJSON(w, http.StatusOK, canaryStatus{Pool: pool.name, Canary: sp.Canary().name, Percent: *req.Percent})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("admin: encoding response", "error", err)
+	}
+}
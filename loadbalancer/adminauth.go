@@ -0,0 +1,146 @@
+package loadbalancer
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// AdminAuthConfig protects the admin API with HTTP Basic Auth, a client IP
+// allowlist, or both. Once the admin listener is enabled, one of them is
+// required unless Disabled is set. Username and Password default to the
+// LB_ADMIN_USERNAME and LB_ADMIN_PASSWORD environment variables.
+//
+// /healthz and /readyz stay open so that orchestrators can probe them.
+type AdminAuthConfig struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// AllowedIPs lists addresses or CIDR ranges, e.g. 10.0.0.0/8, that may
+	// reach the admin API. Empty allows any address.
+	AllowedIPs []string `yaml:"allowed_ips"`
+	// Disabled leaves the admin API open to anyone who can reach it.
+	Disabled bool `yaml:"disabled"`
+}
+
+func (c *AdminAuthConfig) fromEnv() {
+	if c.Username == "" {
+		c.Username = os.Getenv("LB_ADMIN_USERNAME")
+	}
+	if c.Password == "" {
+		c.Password = os.Getenv("LB_ADMIN_PASSWORD")
+	}
+}
+
+func (c AdminAuthConfig) validate() error {
+	if (c.Username == "") != (c.Password == "") {
+		return fmt.Errorf("username and password must be set together")
+	}
+	if _, err := parseAllowedIPs(c.AllowedIPs); err != nil {
+		return err
+	}
+	if !c.Disabled && c.Password == "" && len(c.AllowedIPs) == 0 {
+		return fmt.Errorf("the admin API needs username and password, allowed_ips, or disabled: true")
+	}
+	return nil
+}
+
+func parseAllowedIPs(entries []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(entries))
+	for _, e := range entries {
+		if !strings.Contains(e, "/") {
+			ip := net.ParseIP(e)
+			if ip == nil {
+				return nil, fmt.Errorf("allowed_ips: invalid address %q", e)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(e)
+		if err != nil {
+			return nil, fmt.Errorf("allowed_ips: %w", err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// adminAuth is the compiled form of an AdminAuthConfig.
+type adminAuth struct {
+	username, password string
+	allowed            []*net.IPNet
+}
+
+func newAdminAuth(c AdminAuthConfig) *adminAuth {
+	if c.Disabled {
+		return &adminAuth{}
+	}
+	allowed, _ := parseAllowedIPs(c.AllowedIPs)
+	return &adminAuth{username: c.Username, password: c.Password, allowed: allowed}
+}
+
+func (a *adminAuth) allowIP(r *http.Request) bool {
+	return len(a.allowed) == 0 || remoteIPAllowed(r, a.allowed)
+}
+
+// remoteIPAllowed reports whether r comes from an address in allowed.
+func remoteIPAllowed(r *http.Request, allowed []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *adminAuth) allowCredentials(r *http.Request) bool {
+	if a.password == "" {
+		return true
+	}
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	// Compare both in full so the time taken does not tell which was wrong.
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(a.username)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(a.password)) == 1
+	return userOK && passOK
+}
+
+// requireAdminAuth rejects admin requests from addresses outside the
+// allowlist with 403 and requests without valid credentials with 401. auth
+// is read on every request so that reloads take effect; nil lets everything
+// through.
+func requireAdminAuth(next http.Handler, auth func() *adminAuth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a := auth()
+		if a == nil || r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !a.allowIP(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if !a.allowCredentials(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="goloadbalancer admin", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,479 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Algorithm picks the backend that should serve a request. Pick returns nil
+// when no backend is available.
+type Algorithm interface {
+	Pick(pool *ServerPool, r *http.Request) *Backend
+}
+
+// algorithms maps the names accepted by the algorithm setting to
+// constructors of fresh instances.
+var algorithms = map[string]func() Algorithm{
+	"round-robin":          func() Algorithm { return &RoundRobin{} },
+	"weighted-round-robin": func() Algorithm { return &WeightedRoundRobin{} },
+	"weighted-random":      func() Algorithm { return WeightedRandom{} },
+	"least-conn":           func() Algorithm { return LeastConnections{} },
+	"weighted-least-conn":  func() Algorithm { return WeightedLeastConnections{} },
+	"least-response-time":  func() Algorithm { return &LeastResponseTime{} },
+	"p2c":                  func() Algorithm { return PowerOfTwoChoices{} },
+	"ip-hash":              func() Algorithm { return &IPHash{} },
+	"consistent-hash":      func() Algorithm { return &ConsistentHash{} },
+	"zone-aware":           func() Algorithm { return &ZoneAware{} },
+}
+
+// AlgorithmNames returns the names NewAlgorithm accepts, sorted.
+func AlgorithmNames() []string {
+	names := make([]string, 0, len(algorithms))
+	for name := range algorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewAlgorithm returns a new instance of the algorithm called name, such as
+// "round-robin" or "least-conn"; see AlgorithmNames.
+func NewAlgorithm(name string) (Algorithm, error) {
+	newAlgo, ok := algorithms[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown algorithm %q, want one of %s", name, strings.Join(AlgorithmNames(), ", "))
+	}
+	return newAlgo(), nil
+}
+
+// LatencyObserver is implemented by algorithms that balance on response
+// times. The pool reports how long each successful upstream round trip took,
+// up to the response headers.
+type LatencyObserver interface {
+	ObserveLatency(b *Backend, d time.Duration)
+}
+
+// Rebuilder is implemented by algorithms that keep derived state about the
+// pool's membership. The pool calls Rebuild whenever a backend is added or
+// removed.
+type Rebuilder interface {
+	Rebuild(pool *ServerPool)
+}
+
+// RoundRobin cycles through the available backends in order. current only
+// ever grows; modulo the pool size it is the position of the backend picked
+// last.
+type RoundRobin struct {
+	current uint64
+}
+
+func (rr *RoundRobin) NextIndex(n int) int {
+	return int(atomic.AddUint64(&rr.current, uint64(1)) % uint64(n))
+}
+
+// Pick returns the first available backend after the one picked last. The
+// counter is advanced past every skipped backend, so the next request
+// continues from the backend actually chosen and traffic stays even across
+// the backends that are up.
+func (rr *RoundRobin) Pick(pool *ServerPool, r *http.Request) *Backend {
+	backends := pool.Backends()
+	n := uint64(len(backends))
+	if n == 0 {
+		return nil
+	}
+	for {
+		cur := atomic.LoadUint64(&rr.current)
+		var picked *Backend
+		var step uint64
+		for i := uint64(1); i <= n; i++ {
+			if b := backends[(cur+i)%n]; pool.IsAvailable(b) {
+				picked, step = b, i
+				break
+			}
+		}
+		if picked == nil {
+			return nil
+		}
+		if atomic.CompareAndSwapUint64(&rr.current, cur, cur+step) {
+			return picked
+		}
+	}
+}
+
+// LeastConnections routes to the alive backend with the fewest in-flight
+// requests. Ties go to the backend that was added first.
+type LeastConnections struct{}
+
+func (LeastConnections) Pick(pool *ServerPool, r *http.Request) *Backend {
+	var best *Backend
+	var bestConns int64
+	for _, b := range pool.Backends() {
+		if !pool.IsAvailable(b) {
+			continue
+		}
+		if conns := b.ActiveConns(); best == nil || conns < bestConns {
+			best, bestConns = b, conns
+		}
+	}
+	return best
+}
+
+const defaultDecay = 0.9
+
+// WeightedLeastConnections routes to the available backend with the fewest
+// in-flight requests per unit of weight, so heavier backends carry
+// proportionally more concurrent load. Ties go to the heavier backend, then
+// to the one added first. Backends with weight 0 never receive traffic.
+type WeightedLeastConnections struct{}
+
+func (WeightedLeastConnections) Pick(pool *ServerPool, r *http.Request) *Backend {
+	var best *Backend
+	var bestConns, bestWeight int64
+	for _, b := range pool.Backends() {
+		weight := int64(b.Weight())
+		if weight <= 0 || !pool.IsAvailable(b) {
+			continue
+		}
+		conns := b.ActiveConns()
+		if best == nil {
+			best, bestConns, bestWeight = b, conns, weight
+			continue
+		}
+		// conns/weight < bestConns/bestWeight, without dividing.
+		lhs, rhs := conns*bestWeight, bestConns*weight
+		if lhs < rhs || (lhs == rhs && weight > bestWeight) {
+			best, bestConns, bestWeight = b, conns, weight
+		}
+	}
+	return best
+}
+
+// LeastResponseTime routes to the available backend with the lowest
+// exponentially weighted moving average response time, multiplied by its
+// in-flight requests plus one so that the momentarily fastest backend does
+// not take every request. Backends without a measurement yet score zero and
+// are tried first.
+type LeastResponseTime struct {
+	// Decay is the share of the previous average kept with each new sample,
+	// between 0 and 1. Higher values react more slowly. It defaults to 0.9.
+	Decay float64
+
+	mu   sync.Mutex
+	ewma map[*Backend]float64
+}
+
+func (l *LeastResponseTime) ObserveLatency(b *Backend, d time.Duration) {
+	decay := l.Decay
+	if decay <= 0 || decay >= 1 {
+		decay = defaultDecay
+	}
+	sample := d.Seconds()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ewma == nil {
+		l.ewma = make(map[*Backend]float64)
+	}
+	if avg, ok := l.ewma[b]; ok {
+		sample = decay*avg + (1-decay)*sample
+	}
+	l.ewma[b] = sample
+}
+
+func (l *LeastResponseTime) Pick(pool *ServerPool, r *http.Request) *Backend {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var best *Backend
+	var bestScore float64
+	for _, b := range pool.Backends() {
+		if !pool.IsAvailable(b) {
+			continue
+		}
+		score := l.ewma[b] * float64(b.ActiveConns()+1)
+		if best == nil || score < bestScore {
+			best, bestScore = b, score
+		}
+	}
+	return best
+}
+
+// Rebuild forgets the averages of backends that left the pool.
+func (l *LeastResponseTime) Rebuild(pool *ServerPool) {
+	members := make(map[*Backend]bool)
+	for _, b := range pool.Backends() {
+		members[b] = true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for b := range l.ewma {
+		if !members[b] {
+			delete(l.ewma, b)
+		}
+	}
+}
+
+// PowerOfTwoChoices picks two available backends at random and routes to
+// the one with fewer in-flight requests. It balances nearly as well as
+// LeastConnections without sending every new request to the same idle
+// backend, and costs the same however large the pool is. The random numbers
+// come from math/rand's global source, which is safe for concurrent use
+// without a shared lock.
+type PowerOfTwoChoices struct{}
+
+func (PowerOfTwoChoices) Pick(pool *ServerPool, r *http.Request) *Backend {
+	backends := pool.Backends()
+	first := randomAvailable(pool, backends, nil)
+	if first == nil {
+		return nil
+	}
+	second := randomAvailable(pool, backends, first)
+	if second != nil && second.ActiveConns() < first.ActiveConns() {
+		return second
+	}
+	return first
+}
+
+// p2cProbes is how many random backends are tried before randomAvailable
+// falls back to scanning the pool.
+const p2cProbes = 3
+
+// randomAvailable returns a random available backend other than exclude,
+// or nil if there is none.
+func randomAvailable(pool *ServerPool, backends []*Backend, exclude *Backend) *Backend {
+	n := len(backends)
+	if n == 0 {
+		return nil
+	}
+	for i := 0; i < p2cProbes; i++ {
+		if b := backends[rand.Intn(n)]; b != exclude && pool.IsAvailable(b) {
+			return b
+		}
+	}
+	start := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		if b := backends[(start+i)%n]; b != exclude && pool.IsAvailable(b) {
+			return b
+		}
+	}
+	return nil
+}
+
+// WeightedRoundRobin spreads requests across alive backends in proportion to
+// their weight using nginx's smooth weighted round-robin, so a 4:1 split is
+// interleaved rather than sent in bursts. Backends with weight 0 never
+// receive traffic.
+type WeightedRoundRobin struct {
+	mu      sync.Mutex
+	current map[*Backend]int
+}
+
+func (w *WeightedRoundRobin) Pick(pool *ServerPool, r *http.Request) *Backend {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.current == nil {
+		w.current = make(map[*Backend]int)
+	}
+
+	var best *Backend
+	total := 0
+	for _, b := range pool.Backends() {
+		weight := b.Weight()
+		if weight <= 0 || !pool.IsAvailable(b) {
+			continue
+		}
+		w.current[b] += weight
+		total += weight
+		if best == nil || w.current[b] > w.current[best] {
+			best = b
+		}
+	}
+	if best != nil {
+		w.current[best] -= total
+	}
+	return best
+}
+
+// WeightedRandom picks each available backend with probability weight
+// divided by the total weight of the available backends, so down backends
+// drop out and the rest share their traffic in proportion. Picks are
+// independent: the split converges on the weights over many requests, but
+// unlike WeightedRoundRobin nothing bounds how far a short run strays from
+// it. It keeps no state and takes no lock. Backends with weight 0 never
+// receive traffic.
+type WeightedRandom struct{}
+
+func (WeightedRandom) Pick(pool *ServerPool, r *http.Request) *Backend {
+	backends := pool.Backends()
+	candidates := make([]*Backend, 0, len(backends))
+	cumulative := make([]int, 0, len(backends))
+	total := 0
+	for _, b := range backends {
+		weight := b.Weight()
+		if weight <= 0 || !pool.IsAvailable(b) {
+			continue
+		}
+		total += weight
+		candidates = append(candidates, b)
+		cumulative = append(cumulative, total)
+	}
+	if total == 0 {
+		return nil
+	}
+	x := rand.Intn(total)
+	return candidates[sort.Search(len(cumulative), func(i int) bool { return cumulative[i] > x })]
+}
+
+// Rebuild forgets the running weights of backends that left the pool.
+func (w *WeightedRoundRobin) Rebuild(pool *ServerPool) {
+	members := make(map[*Backend]bool)
+	for _, b := range pool.Backends() {
+		members[b] = true
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for b := range w.current {
+		if !members[b] {
+			delete(w.current, b)
+		}
+	}
+}
+
+// IPHash pins each client to a backend by hashing its IP address over the set
+// of alive backends. Because only alive backends are considered, a client
+// whose backend goes down is moved deterministically to another one.
+type IPHash struct {
+	// Hash defaults to 32-bit FNV-1a.
+	Hash func([]byte) uint32
+	// UseXFF keys on the first hop of X-Forwarded-For when present instead
+	// of the connection's remote address.
+	UseXFF bool
+}
+
+func (h *IPHash) Pick(pool *ServerPool, r *http.Request) *Backend {
+	backends := pool.Backends()
+	alive := make([]*Backend, 0, len(backends))
+	for _, b := range backends {
+		if pool.IsAvailable(b) {
+			alive = append(alive, b)
+		}
+	}
+	if len(alive) == 0 {
+		return nil
+	}
+
+	hash := h.Hash
+	if hash == nil {
+		hash = fnv32a
+	}
+	return alive[hash([]byte(clientIP(r, h.UseXFF)))%uint32(len(alive))]
+}
+
+func fnv32a(b []byte) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write(b)
+	return h.Sum32()
+}
+
+func clientIP(r *http.Request, useXFF bool) string {
+	if useXFF {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			first, _, _ := strings.Cut(xff, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+const defaultReplicas = 150
+
+// ConsistentHash maps requests onto a hash ring holding Replicas virtual nodes
+// per backend, so adding or removing a backend only remaps about 1/N of the
+// keys. Requests are keyed on the client IP, or on Header when it is set.
+type ConsistentHash struct {
+	Replicas int
+	Header   string
+
+	mu     sync.RWMutex
+	hashes []uint32
+	nodes  map[uint32]*Backend
+}
+
+func (c *ConsistentHash) Rebuild(pool *ServerPool) {
+	replicas := c.Replicas
+	if replicas <= 0 {
+		replicas = defaultReplicas
+	}
+
+	backends := pool.Backends()
+	hashes := make([]uint32, 0, len(backends)*replicas)
+	nodes := make(map[uint32]*Backend, len(backends)*replicas)
+	for _, b := range backends {
+		for i := 0; i < replicas; i++ {
+			h := fnv32a([]byte(b.url.String() + "#" + strconv.Itoa(i)))
+			if _, taken := nodes[h]; taken {
+				continue
+			}
+			nodes[h] = b
+			hashes = append(hashes, h)
+		}
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+
+	c.mu.Lock()
+	c.hashes, c.nodes = hashes, nodes
+	c.mu.Unlock()
+}
+
+func (c *ConsistentHash) Pick(pool *ServerPool, r *http.Request) *Backend {
+	c.mu.RLock()
+	built := c.nodes != nil
+	c.mu.RUnlock()
+	if !built {
+		c.Rebuild(pool)
+	}
+
+	key := ""
+	if c.Header != "" {
+		key = r.Header.Get(c.Header)
+	}
+	if key == "" {
+		key = clientIP(r, false)
+	}
+	return c.lookup(pool, fnv32a([]byte(key)))
+}
+
+// lookup walks the ring clockwise from h and returns the first available
+// backend.
+func (c *ConsistentHash) lookup(pool *ServerPool, h uint32) *Backend {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	n := len(c.hashes)
+	if n == 0 {
+		return nil
+	}
+	start := sort.Search(n, func(i int) bool { return c.hashes[i] >= h })
+	for i := 0; i < n; i++ {
+		if b := c.nodes[c.hashes[(start+i)%n]]; pool.IsAvailable(b) {
+			return b
+		}
+	}
+	return nil
+}
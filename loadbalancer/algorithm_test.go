@@ -0,0 +1,129 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// newTestPool returns a pool balancing over n backends with the named
+// algorithm. Slow start is disabled so every backend gets its full weight.
+func newTestPool(tb testing.TB, algorithm string, n int) *ServerPool {
+	tb.Helper()
+	algo, err := NewAlgorithm(algorithm)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	pool := NewServerPool()
+	pool.setAlgorithm(algo, algorithm)
+	pool.SetSlowStart(0)
+	for i := 1; i <= n; i++ {
+		u, err := url.Parse(fmt.Sprintf("http://10.0.0.%d:80", i))
+		if err != nil {
+			tb.Fatal(err)
+		}
+		pool.AddBackend(newBackend(u, pool))
+	}
+	return pool
+}
+
+// pickCounts picks a backend n times and counts the picks per backend.
+func pickCounts(tb testing.TB, pool *ServerPool, n int) map[*Backend]int {
+	tb.Helper()
+	r := httptest.NewRequest("GET", "/", nil)
+	counts := make(map[*Backend]int)
+	for i := 0; i < n; i++ {
+		b := pool.GetNextPeer(r)
+		if b == nil {
+			tb.Fatal("no peer picked")
+		}
+		counts[b]++
+	}
+	return counts
+}
+
+func TestRoundRobinSkipsDownBackendEvenly(t *testing.T) {
+	const picks = 3000
+	for down := 0; down < 3; down++ {
+		pool := newTestPool(t, "round-robin", 3)
+		backends := pool.Backends()
+		backends[down].SetAlive(false)
+
+		counts := pickCounts(t, pool, picks)
+		for i, b := range backends {
+			got := counts[b]
+			if i == down {
+				if got != 0 {
+					t.Errorf("down backend %s picked %d times", b.url, got)
+				}
+				continue
+			}
+			// Round-robin over the two live backends alternates strictly.
+			if got < picks/2-1 || got > picks/2+1 {
+				t.Errorf("with %s down, %s picked %d times, want %d±1", backends[down].url, b.url, got, picks/2)
+			}
+		}
+	}
+}
+
+func TestWeightedRandomFollowsWeights(t *testing.T) {
+	pool := newTestPool(t, "weighted-random", 5)
+	backends := pool.Backends()
+	weights := []int{1, 2, 3, 4, 0}
+	for i, b := range backends {
+		b.SetWeight(weights[i])
+	}
+
+	// With 100000 picks one percentage point is about ten standard
+	// deviations of any backend's share.
+	const picks, tolerance = 100000, 0.01
+	check := func(down int) {
+		t.Helper()
+		total := 0
+		for i, w := range weights {
+			if i != down {
+				total += w
+			}
+		}
+		counts := pickCounts(t, pool, picks)
+		for i, b := range backends {
+			want := float64(weights[i]) / float64(total)
+			if i == down {
+				want = 0
+			}
+			got := float64(counts[b]) / picks
+			if want == 0 && counts[b] != 0 {
+				t.Errorf("%s with weight %d picked %d times, want none", b.url, weights[i], counts[b])
+			} else if got < want-tolerance || got > want+tolerance {
+				t.Errorf("%s with weight %d got %.3f of the picks, want %.3f±%.2f", b.url, weights[i], got, want, tolerance)
+			}
+		}
+	}
+	check(-1)
+
+	// A down backend's share goes to the others in proportion to their
+	// weights.
+	backends[1].SetAlive(false)
+	check(1)
+}
+
+func BenchmarkGetNextPeer(b *testing.B) {
+	for _, name := range AlgorithmNames() {
+		name := name
+		b.Run(name, func(b *testing.B) {
+			pool := newTestPool(b, name, 10)
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				r := httptest.NewRequest("GET", "/", nil)
+				for pb.Next() {
+					if pool.GetNextPeer(r) == nil {
+						b.Error("no peer picked")
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,629 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Backend is always handled through a pointer; its mutex guards isAlive,
+// draining, adminAdded, weight, the configured weight, priority, tags,
+// timeout, rewriteHost, pathRewrite, transport, the passive failure streak, the
+// slow-start timestamp and the health check override, streaks and result and
+// must not be copied.
+type Backend struct {
+	url   *url.URL
+	proxy *httputil.ReverseProxy
+	// pool is the pool the backend was added to. Its settings apply to
+	// requests forwarded to the backend.
+	pool     *ServerPool
+	isAlive  bool
+	draining bool
+	// adminAdded is set for backends added through the admin API that the
+	// configuration does not list; reconciling leaves them in the pool.
+	adminAdded  bool
+	mux         sync.RWMutex
+	activeConns int64
+	// maxConns caps activeConns when positive. It is accessed atomically.
+	maxConns int64
+	weight   int
+	// configWeight is the weight last set from the configuration, which
+	// the admin API may have overridden since; see setConfiguredWeight.
+	configWeight     int
+	weightConfigured bool
+	// priority is the backend's failover tier; see SetPriority.
+	priority int
+	tags     map[string]string
+	// timeout overrides the pool's request timeout when non-zero.
+	timeout time.Duration
+	// rewriteHost sends the backend's own host as the Host header instead of
+	// the client's.
+	rewriteHost bool
+	pathRewrite PathRewrite
+	// transport, when set, replaces the pool's shared transport for this
+	// backend. tlsConfig is the override it was built from.
+	transport http.RoundTripper
+	tlsConfig *UpstreamTLSConfig
+	// transportCfg is the pool setting transport was built with.
+	transportCfg TransportConfig
+
+	failures     int
+	firstFailure time.Time
+	healthySince time.Time
+
+	// probesPassed and probesFailed count the latest active health checks
+	// that passed or failed in a row.
+	probesPassed int
+	probesFailed int
+	lastCheck    CheckResult
+	// healthOverride replaces parts of the pool's health check.
+	healthOverride *HealthCheckOverride
+
+	circuit circuit
+}
+
+// NewBackend returns a backend for rawURL whose reverse proxy retries and
+// fails over according to pool's settings. The backend starts alive with
+// weight 1; it still has to be added to pool with AddBackend.
+func NewBackend(rawURL string, pool *ServerPool) (*Backend, error) {
+	u, err := parseBackendURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return newBackend(u, pool), nil
+}
+
+func newBackend(u *url.URL, pool *ServerPool) *Backend {
+	b := &Backend{
+		url:     u,
+		pool:    pool,
+		isAlive: true,
+		weight:  1,
+	}
+	b.proxy = newProxy(b)
+	return b
+}
+
+// parseBackendURL parses a backend address, which needs a scheme and a host,
+// or is a unix:// URL naming a socket, such as unix:///run/app.sock.
+func parseBackendURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url %q: %w", rawURL, err)
+	}
+	if u.Scheme == schemeUnix {
+		if u.Host != "" || u.Path == "" {
+			return nil, fmt.Errorf("invalid url %q: want unix:///path/to/socket", rawURL)
+		}
+		return u, nil
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid url %q: scheme and host are required", rawURL)
+	}
+	return u, nil
+}
+
+// SetAlive marks the backend up or down. The pool's state hooks are called
+// when this changes the backend's state.
+func (b *Backend) SetAlive(alive bool) {
+	b.setAlive(alive)
+}
+
+// setAlive is SetAlive, reporting whether the state changed.
+func (b *Backend) setAlive(alive bool) bool {
+	b.mux.Lock()
+	changed := alive != b.isAlive
+	if alive && changed {
+		b.healthySince = time.Now()
+	}
+	if changed {
+		// Health check streaks count towards the next change only.
+		b.probesPassed, b.probesFailed = 0, 0
+	}
+	b.isAlive = alive
+	b.mux.Unlock()
+	if changed && b.pool != nil {
+		b.pool.refreshTier()
+		b.pool.notifyState(b, alive)
+		b.pool.publishState(b)
+	}
+	return changed
+}
+
+func (b *Backend) IsAlive() (alive bool) {
+	b.mux.RLock()
+	alive = b.isAlive
+	b.mux.RUnlock()
+	return
+}
+
+// SetDraining takes the backend out of rotation for new requests while
+// letting in-flight ones finish. Unlike a down backend it keeps being health
+// checked normally.
+func (b *Backend) SetDraining(draining bool) {
+	b.mux.Lock()
+	changed := draining != b.draining
+	b.draining = draining
+	b.mux.Unlock()
+	if changed && b.pool != nil {
+		b.pool.refreshTier()
+		b.pool.publishState(b)
+	}
+}
+
+func (b *Backend) setAdminAdded(added bool) {
+	b.mux.Lock()
+	b.adminAdded = added
+	b.mux.Unlock()
+}
+
+func (b *Backend) isAdminAdded() (added bool) {
+	b.mux.RLock()
+	added = b.adminAdded
+	b.mux.RUnlock()
+	return
+}
+
+func (b *Backend) IsDraining() (draining bool) {
+	b.mux.RLock()
+	draining = b.draining
+	b.mux.RUnlock()
+	return
+}
+
+func (b *Backend) SetWeight(weight int) {
+	b.mux.Lock()
+	b.weight = weight
+	b.mux.Unlock()
+}
+
+func (b *Backend) Weight() (weight int) {
+	b.mux.RLock()
+	weight = b.weight
+	b.mux.RUnlock()
+	return
+}
+
+// setConfiguredWeight sets the weight from the configuration. A weight
+// changed through the admin API is only replaced once the configured value
+// itself changes, so reloads and discovery rounds that repeat the same
+// configuration keep it. It reports whether the weight was set.
+func (b *Backend) setConfiguredWeight(weight int) (changed bool) {
+	b.mux.Lock()
+	if !b.weightConfigured || b.configWeight != weight {
+		changed = b.weight != weight
+		b.weight = weight
+		b.configWeight = weight
+		b.weightConfigured = true
+	}
+	b.mux.Unlock()
+	return
+}
+
+func (b *Backend) SetTimeout(timeout time.Duration) {
+	b.mux.Lock()
+	b.timeout = timeout
+	b.mux.Unlock()
+}
+
+func (b *Backend) Timeout() (timeout time.Duration) {
+	b.mux.RLock()
+	timeout = b.timeout
+	b.mux.RUnlock()
+	return
+}
+
+// SetRewriteHost makes requests to the backend carry the backend's host in
+// the Host header rather than the one the client sent.
+func (b *Backend) SetRewriteHost(rewrite bool) {
+	b.mux.Lock()
+	b.rewriteHost = rewrite
+	b.mux.Unlock()
+}
+
+func (b *Backend) RewriteHost() (rewrite bool) {
+	b.mux.RLock()
+	rewrite = b.rewriteHost
+	b.mux.RUnlock()
+	return
+}
+
+// SetUpstreamTLS gives the backend its own transport built from c and the
+// pool's transport settings, or makes it use the pool's shared transport
+// again when c is nil. Unix socket backends always have their own
+// transport. The transport is only rebuilt when the settings change.
+func (b *Backend) SetUpstreamTLS(c *UpstreamTLSConfig) error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	unix := b.url.Scheme == schemeUnix
+	if c == nil && !unix {
+		b.transport, b.tlsConfig = nil, nil
+		return nil
+	}
+	tc := b.pool.TransportConfig()
+	if b.transport != nil && sameTLS(b.tlsConfig, c) && b.transportCfg == tc {
+		return nil
+	}
+	var tlsCfg UpstreamTLSConfig
+	if c != nil {
+		tlsCfg = *c
+	}
+	t, err := newTransport(tc, tlsCfg)
+	if err != nil {
+		return err
+	}
+	if unix {
+		dialer := &net.Dialer{Timeout: tc.DialTimeout}
+		t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", b.url.Path)
+		}
+	}
+	b.tlsConfig = nil
+	if c != nil {
+		cc := *c
+		b.tlsConfig = &cc
+	}
+	b.transport, b.transportCfg = t, tc
+	return nil
+}
+
+func sameTLS(a, b *UpstreamTLSConfig) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// upstreamTransport returns the transport requests to b go through: its own
+// when it has TLS overrides or is a unix socket, the pool's otherwise.
+// Health probes use it too, so they see the same certificates.
+func (b *Backend) upstreamTransport() (http.RoundTripper, error) {
+	b.mux.RLock()
+	t := b.transport
+	b.mux.RUnlock()
+	if t == nil && b.url.Scheme == schemeUnix {
+		// Not configured through a pool config yet.
+		if err := b.SetUpstreamTLS(nil); err != nil {
+			return nil, err
+		}
+		b.mux.RLock()
+		t = b.transport
+		b.mux.RUnlock()
+	}
+	if t == nil {
+		t = b.pool.Transport()
+	}
+	return t, nil
+}
+
+// upstreamTLSConfig returns a copy of the TLS settings of b's transport,
+// for clients that reach the backend other than through it.
+func (b *Backend) upstreamTLSConfig() (*tls.Config, error) {
+	t, err := b.upstreamTransport()
+	if err != nil {
+		return nil, err
+	}
+	if ht, ok := t.(*http.Transport); ok && ht.TLSClientConfig != nil {
+		cfg := ht.TLSClientConfig.Clone()
+		// Left to the client, which negotiates its own protocol.
+		cfg.NextProtos = nil
+		return cfg, nil
+	}
+	return &tls.Config{}, nil
+}
+
+func (b *Backend) roundTrip(r *http.Request) (*http.Response, error) {
+	t, err := b.upstreamTransport()
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	resp, err := t.RoundTrip(r)
+	d := time.Since(start)
+	b.pool.stats().observeLatency(b, d)
+	if err == nil {
+		b.pool.observeLatency(b, d)
+	}
+	return resp, err
+}
+
+// CheckResult is the outcome of a backend's latest active health check.
+type CheckResult struct {
+	// At is when the probe started; it is zero until the first check.
+	At       time.Time
+	Duration time.Duration
+	// Err is why the probe failed, or nil if it passed.
+	Err error
+}
+
+func (b *Backend) recordCheck(res CheckResult) {
+	b.mux.Lock()
+	b.lastCheck = res
+	b.mux.Unlock()
+}
+
+// LastCheck returns the outcome of the backend's latest health check.
+func (b *Backend) LastCheck() CheckResult {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.lastCheck
+}
+
+// info copies the backend's state, reading it under a single lock.
+func (b *Backend) info() BackendInfo {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return BackendInfo{
+		URL:         b.url.String(),
+		Alive:       b.isAlive,
+		Draining:    b.draining,
+		Weight:      b.weight,
+		ActiveConns: b.ActiveConns(),
+		Priority:    b.priority,
+		Tags:        b.tagsLocked(),
+		LastCheck:   checkInfoOf(b.lastCheck),
+	}
+}
+
+func (b *Backend) ActiveConns() int64 {
+	return atomic.LoadInt64(&b.activeConns)
+}
+
+// SetMaxConns caps the number of requests in flight to the backend. Zero
+// removes the cap.
+func (b *Backend) SetMaxConns(n int64) {
+	atomic.StoreInt64(&b.maxConns, n)
+}
+
+func (b *Backend) MaxConns() int64 {
+	return atomic.LoadInt64(&b.maxConns)
+}
+
+// AtCapacity reports whether the backend has reached its connection cap.
+func (b *Backend) AtCapacity() bool {
+	limit := b.MaxConns()
+	return limit > 0 && b.ActiveConns() >= limit
+}
+
+// acquire counts a new request as in flight unless the backend is at its
+// connection cap, and reports whether it did.
+func (b *Backend) acquire() bool {
+	for {
+		n, limit := b.ActiveConns(), b.MaxConns()
+		if limit > 0 && n >= limit {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.activeConns, n, n+1) {
+			return true
+		}
+	}
+}
+
+func (b *Backend) release() {
+	atomic.AddInt64(&b.activeConns, -1)
+}
+
+// ServeHTTP forwards the request to the backend, counting it as in flight
+// until the proxy returns, or replies with 503 when the backend is at its
+// connection cap.
+func (b *Backend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !b.acquire() {
+		b.pool.ErrorPage().write(w, http.StatusServiceUnavailable, "Service unavailable")
+		return
+	}
+	defer b.release()
+	b.serve(w, r)
+}
+
+// serve forwards a request the caller has already acquired a slot for.
+// Retries and failovers triggered from the proxy's ErrorHandler happen
+// inside this call, so the slot is held until they are done.
+func (b *Backend) serve(w http.ResponseWriter, r *http.Request) {
+	if _, ok := w.(*responseTracker); !ok {
+		w = &responseTracker{ResponseWriter: w}
+	}
+	defer b.circuit.release()
+	b.pool.stats().backendRequests.WithLabelValues(b.url.String()).Inc()
+	b.forward(w, r)
+}
+
+type baseContextKey struct{}
+
+// forward sends a single attempt to the backend, bounded by the backend's
+// request timeout or the pool's. The context the timeout was derived from is
+// kept on the request so that retries get a fresh deadline. Upgrade requests
+// such as WebSocket handshakes are not bounded: the proxy tears the upgraded
+// connection down when the request context ends, and such connections are
+// expected to be long-lived. A buffered body is sent from its start on every
+// attempt.
+func (b *Backend) forward(w http.ResponseWriter, r *http.Request) {
+	timeout := b.Timeout()
+	if timeout == 0 {
+		timeout = b.pool.RequestTimeout()
+	}
+	if timeout > 0 && !isUpgrade(r) {
+		base := baseContext(r)
+		ctx, cancel := context.WithTimeout(base, timeout)
+		defer cancel()
+		r = r.WithContext(context.WithValue(ctx, baseContextKey{}, base))
+	}
+	if bb := bufferedBodyFrom(r); bb != nil {
+		r = r.WithContext(r.Context())
+		r.Body = bb.reader()
+	}
+	b.proxy.ServeHTTP(w, r)
+}
+
+// baseContext returns the request's context without the per-attempt timeout
+// applied by forward.
+func baseContext(r *http.Request) context.Context {
+	if base, ok := r.Context().Value(baseContextKey{}).(context.Context); ok {
+		return base
+	}
+	return r.Context()
+}
+
+// newProxy builds the reverse proxy for a backend. Its ErrorHandler retries
+// the same backend a few times before marking it down and handing the
+// request back to the backend's pool to try another one.
+func newProxy(b *Backend) *httputil.ReverseProxy {
+	u := b.url
+	target := u
+	if u.Scheme == schemeUnix {
+		// The transport dials the socket whatever the address.
+		target = &url.URL{Scheme: "http", Host: "localhost"}
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = roundTripperFunc(b.roundTrip)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		// Upgrade requests keep their Upgrade and Connection headers; the
+		// reverse proxy forwards just those itself.
+		if !isUpgrade(r) {
+			removeHopHeaders(r.Header)
+		}
+		// The original Host is still on r at this point.
+		if b.pool.ForwardedHeaders() {
+			setForwardedHeaders(r)
+		} else {
+			// A nil value keeps the reverse proxy from appending the
+			// client address, which it otherwise always does.
+			r.Header["X-Forwarded-For"] = nil
+		}
+		b.PathRewrite().apply(r.URL)
+		director(r)
+		if b.RewriteHost() {
+			r.Host = target.Host
+		}
+		propagator.Inject(r.Context(), propagation.HeaderCarrier(r.Header))
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		// Nothing has been written to the client yet, so the response can
+		// still be swapped for another try.
+		if err := b.pool.RetryPolicy().retryStatus(resp, b); err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			removeHopHeaders(resp.Header)
+			b.pool.maskResponse(resp)
+		}
+		if b.pool.DebugHeaders() {
+			resp.Header.Set("X-LB-Backend", u.String())
+			resp.Header.Set("X-LB-Attempts", strconv.Itoa(GetAttemptsFromContext(resp.Request)+1))
+			resp.Header.Set("X-LB-Retries", strconv.Itoa(GetRetryFromContext(resp.Request)))
+		}
+		b.resetFailures()
+		if b.circuit.success() {
+			slog.Info("circuit breaker closed", "backend", u.String())
+		}
+		return nil
+	}
+	proxy.ErrorHandler = func(writer http.ResponseWriter, request *http.Request, e error) {
+		base := baseContext(request)
+		if base.Err() != nil {
+			// The client went away; there is nobody left to retry for.
+			slog.Debug("client disconnected", "backend", u.String(), "remote_addr", request.RemoteAddr, "path", request.URL.Path)
+			return
+		}
+		var tooLarge *http.MaxBytesError
+		if errors.As(e, &tooLarge) {
+			// The client's fault, not the backend's: neither retry nor
+			// count it against the backend.
+			slog.Warn("request body too large", "backend", u.String(), "remote_addr", request.RemoteAddr, "path", request.URL.Path, "limit", tooLarge.Limit)
+			b.pool.ErrorPage().write(writer, http.StatusRequestEntityTooLarge, "Request body too large")
+			return
+		}
+		timedOut := errors.Is(e, context.DeadlineExceeded)
+		// A status listed in retry.on_status is retried but, the backend
+		// having answered, not held against it.
+		var status statusError
+		onStatus := errors.As(e, &status)
+		if onStatus {
+			slog.Info("retrying on upstream status", "backend", u.String(), "remote_addr", request.RemoteAddr, "path", request.URL.Path, "request_id", requestIDFrom(request), "status", status.code)
+		} else {
+			slog.Warn("proxy error", "backend", u.String(), "remote_addr", request.RemoteAddr, "path", request.URL.Path, "request_id", requestIDFrom(request), "error", e)
+			b.pool.stats().failedForwards.WithLabelValues(u.String()).Inc()
+			if b.recordFailure(b.pool.PassiveHealthCheck()) {
+				slog.Warn("passive health check marked backend down", "backend", u.String(), "failures", b.consecutiveFailures())
+				b.SetAlive(false)
+			}
+			if b.circuit.failure(b.pool.CircuitBreaker()) {
+				slog.Warn("circuit breaker opened", "backend", u.String())
+			}
+		}
+		policy := b.pool.RetryPolicy()
+		if rt, ok := writer.(*responseTracker); ok && rt.started {
+			// Part of the response is already with the client; another
+			// attempt could only corrupt it.
+			slog.Warn("response already started, not retrying", "backend", u.String(), "remote_addr", request.RemoteAddr, "path", request.URL.Path)
+			return
+		}
+		if !policy.allows(request.Method) || !canReplay(request) {
+			slog.Warn("request is not retryable, terminating", "backend", u.String(), "remote_addr", request.RemoteAddr, "path", request.URL.Path, "method", request.Method)
+			if timedOut {
+				b.pool.ErrorPage().write(writer, http.StatusGatewayTimeout, "Gateway timeout")
+				return
+			}
+			b.pool.ErrorPage().write(writer, http.StatusBadGateway, "Bad gateway")
+			return
+		}
+		retries := GetRetryFromContext(request)
+		if retries < policy.Retries {
+			b.pool.stats().retries.Inc()
+			traceRetry(request, b, retries+1, e)
+			select {
+			case <-time.After(policy.backoff(retries)):
+				ctx := context.WithValue(base, Retry, retries+1)
+				b.forward(writer, request.WithContext(ctx))
+			case <-base.Done():
+			}
+			return
+		}
+		if forcedBackendFrom(request) != nil {
+			// The client asked for this backend; there is nothing to fail
+			// over to.
+			slog.Warn("forced backend failed, terminating", "remote_addr", request.RemoteAddr, "path", request.URL.Path, "backend", u.String())
+			if timedOut {
+				b.pool.ErrorPage().write(writer, http.StatusGatewayTimeout, "Gateway timeout")
+				return
+			}
+			b.pool.ErrorPage().write(writer, http.StatusBadGateway, "Bad gateway")
+			return
+		}
+
+		if !onStatus {
+			b.pool.MarkBackendStatus(u, false)
+		}
+
+		attemps := GetAttemptsFromContext(request)
+		if attemps >= policy.MaxAttempts && timedOut {
+			slog.Warn("upstream timed out, terminating", "remote_addr", request.RemoteAddr, "path", request.URL.Path, "backend", u.String(), "attempt", attemps)
+			b.pool.ErrorPage().write(writer, http.StatusGatewayTimeout, "Gateway timeout")
+			return
+		}
+		if attemps < policy.MaxAttempts {
+			b.pool.stats().retries.Inc()
+			slog.Info("retrying on another backend", "remote_addr", request.RemoteAddr, "path", request.URL.Path, "backend", u.String(), "attempt", attemps+1)
+		}
+		// The next backend gets its own set of retries.
+		ctx := context.WithValue(base, Retry, 0)
+		ctx = context.WithValue(ctx, Attempts, attemps+1)
+		if onStatus {
+			ctx = withTried(ctx, b)
+		}
+		b.pool.ServeHTTP(writer, request.WithContext(ctx))
+	}
+	return proxy
+}
@@ -0,0 +1,158 @@
+package loadbalancer
+
+import (
+	"sync"
+	"time"
+)
+
+// CircuitBreaker configures the per-backend breaker. After MaxFailures
+// consecutive proxy errors the breaker opens and the backend is skipped for
+// Cooldown. It then lets a single probe request through: success closes the
+// breaker, failure re-opens it with the cooldown doubled up to MaxCooldown.
+// A MaxFailures of 0 disables the breaker.
+type CircuitBreaker struct {
+	MaxFailures int           `yaml:"max_failures"`
+	Cooldown    time.Duration `yaml:"cooldown"`
+	MaxCooldown time.Duration `yaml:"max_cooldown"`
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+type circuit struct {
+	mu        sync.Mutex
+	state     breakerState
+	failures  int
+	cooldown  time.Duration
+	openUntil time.Time
+	probing   bool
+	// probeUntil is when an unreleased probe reservation lapses, so that a
+	// reservation made for a candidate the algorithm did not pick cannot hold
+	// the breaker half-open forever.
+	probeUntil time.Time
+}
+
+// allow reports whether the breaker lets a new request through. An open
+// breaker whose cooldown has elapsed moves to half-open, where only one probe
+// may be in flight at a time. The caller that is let through in half-open
+// state holds the probe until release, success or failure.
+func (c *circuit) allow(cb CircuitBreaker) bool {
+	if cb.MaxFailures <= 0 {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.state {
+	case breakerOpen:
+		if time.Now().Before(c.openUntil) {
+			return false
+		}
+		c.state = breakerHalfOpen
+		c.reserve()
+		return true
+	case breakerHalfOpen:
+		if c.probing && time.Now().Before(c.probeUntil) {
+			return false
+		}
+		c.reserve()
+		return true
+	default:
+		return true
+	}
+}
+
+// wouldAllow reports whether allow would let a request through, without
+// moving the breaker to half-open or taking the probe.
+func (c *circuit) wouldAllow(cb CircuitBreaker) bool {
+	if cb.MaxFailures <= 0 {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.state {
+	case breakerOpen:
+		return !time.Now().Before(c.openUntil)
+	case breakerHalfOpen:
+		return !c.probing || !time.Now().Before(c.probeUntil)
+	default:
+		return true
+	}
+}
+
+// reserve takes the half-open probe. c.mu must be held.
+func (c *circuit) reserve() {
+	c.probing = true
+	c.probeUntil = time.Now().Add(max(c.cooldown, time.Second))
+}
+
+// release gives up the probe if the request holding it finished without
+// reporting success or failure, for example because the client went away.
+func (c *circuit) release() {
+	c.mu.Lock()
+	if c.state == breakerHalfOpen {
+		c.probing = false
+	}
+	c.mu.Unlock()
+}
+
+// success closes the breaker and reports whether it was not closed before.
+func (c *circuit) success() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	changed := c.state != breakerClosed
+	c.state = breakerClosed
+	c.failures = 0
+	c.cooldown = 0
+	c.probing = false
+	return changed
+}
+
+// failure records a failed request and reports whether it opened the breaker.
+func (c *circuit) failure(cb CircuitBreaker) bool {
+	if cb.MaxFailures <= 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.state {
+	case breakerHalfOpen:
+		c.cooldown *= 2
+		if cb.MaxCooldown > 0 && c.cooldown > cb.MaxCooldown {
+			c.cooldown = cb.MaxCooldown
+		}
+	case breakerClosed:
+		c.failures++
+		if c.failures < cb.MaxFailures {
+			return false
+		}
+		c.cooldown = cb.Cooldown
+	default:
+		return false
+	}
+	c.state = breakerOpen
+	c.probing = false
+	c.openUntil = time.Now().Add(c.cooldown)
+	return true
+}
+
+func (c *circuit) State() breakerState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
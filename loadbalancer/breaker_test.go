@@ -0,0 +1,39 @@
+package loadbalancer
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitHalfOpenProbe(t *testing.T) {
+	cb := CircuitBreaker{MaxFailures: 1, Cooldown: time.Minute}
+	var c circuit
+	if !c.failure(cb) {
+		t.Fatal("failure did not open the breaker")
+	}
+	c.openUntil = time.Now()
+
+	if !c.allow(cb) {
+		t.Fatal("cooled-down breaker did not let the probe through")
+	}
+	if c.allow(cb) {
+		t.Fatal("second request let through while the probe is in flight")
+	}
+
+	// A probe that ends without success or failure, e.g. on a client
+	// disconnect, must hand the probe back.
+	c.release()
+	if !c.allow(cb) {
+		t.Fatal("probe not released")
+	}
+
+	// An unreleased reservation lapses.
+	c.probeUntil = time.Now()
+	if !c.allow(cb) {
+		t.Fatal("stale probe reservation did not lapse")
+	}
+
+	if !c.success() || c.State() != breakerClosed {
+		t.Fatal("successful probe did not close the breaker")
+	}
+}
@@ -0,0 +1,128 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// BodyBufferConfig controls how much of a request body is kept so that the
+// request can be retried or failed over with its full body. Bodies up to
+// MemoryLimit bytes are kept in memory; larger ones spill to a temporary
+// file of up to FileLimit more bytes. Requests with a body that fits in
+// neither are forwarded as they stream in and are never retried.
+type BodyBufferConfig struct {
+	MemoryLimit int64 `yaml:"memory_limit"`
+	FileLimit   int64 `yaml:"file_limit"`
+}
+
+func (c BodyBufferConfig) validate() error {
+	if c.MemoryLimit < 0 || c.FileLimit < 0 {
+		return errors.New("limits must not be negative")
+	}
+	return nil
+}
+
+// bufferedBody is a request body read in full, which every forwarding
+// attempt reads again from the start.
+type bufferedBody struct {
+	data []byte
+	file *os.File
+	size int64
+}
+
+func (b *bufferedBody) reader() io.ReadCloser {
+	if b.file != nil {
+		return io.NopCloser(io.NewSectionReader(b.file, 0, b.size))
+	}
+	return io.NopCloser(bytes.NewReader(b.data))
+}
+
+// close removes the temporary file, if any.
+func (b *bufferedBody) close() {
+	if b.file != nil {
+		_ = b.file.Close()
+		_ = os.Remove(b.file.Name())
+	}
+}
+
+type bufferedBodyKey struct{}
+
+func bufferedBodyFrom(r *http.Request) *bufferedBody {
+	b, _ := r.Context().Value(bufferedBodyKey{}).(*bufferedBody)
+	return b
+}
+
+func hasBody(r *http.Request) bool {
+	return r.Body != nil && r.Body != http.NoBody
+}
+
+// canReplay reports whether r can be sent again: it has no body, or its
+// body was buffered.
+func canReplay(r *http.Request) bool {
+	return !hasBody(r) || bufferedBodyFrom(r) != nil
+}
+
+// bufferBody reads r's body within c's limits. If it fits, the returned
+// request carries the buffered body. Otherwise the returned request streams
+// what was read followed by the rest of the body. The caller must call the
+// returned cleanup function once the request is done.
+func bufferBody(r *http.Request, c BodyBufferConfig) (*http.Request, func(), error) {
+	noop := func() {}
+	if c.MemoryLimit <= 0 && c.FileLimit <= 0 {
+		return r, noop, nil
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, c.MemoryLimit+1))
+	if err != nil {
+		return r, noop, err
+	}
+	if int64(len(data)) <= c.MemoryLimit {
+		_ = r.Body.Close()
+		return withBufferedBody(r, &bufferedBody{data: data, size: int64(len(data))}), noop, nil
+	}
+	if c.FileLimit <= 0 {
+		return streamBody(r, bytes.NewReader(data)), noop, nil
+	}
+
+	f, err := os.CreateTemp("", "lb-body-*")
+	if err != nil {
+		return r, noop, fmt.Errorf("buffering request body: %w", err)
+	}
+	bb := &bufferedBody{file: f}
+	limit := c.MemoryLimit + c.FileLimit
+	bb.size, err = io.Copy(f, io.LimitReader(io.MultiReader(bytes.NewReader(data), r.Body), limit+1))
+	if err != nil {
+		bb.close()
+		return r, noop, err
+	}
+	if bb.size <= limit {
+		_ = r.Body.Close()
+		return withBufferedBody(r, bb), bb.close, nil
+	}
+	// Still too large. What was read is streamed from the file, which stays
+	// around until the request is done.
+	return streamBody(r, io.NewSectionReader(f, 0, bb.size)), bb.close, nil
+}
+
+func withBufferedBody(r *http.Request, bb *bufferedBody) *http.Request {
+	r = r.WithContext(context.WithValue(r.Context(), bufferedBodyKey{}, bb))
+	r.Body = bb.reader()
+	r.ContentLength = bb.size
+	r.TransferEncoding = nil
+	return r
+}
+
+// streamBody makes r read head and then whatever is left of its body.
+func streamBody(r *http.Request, head io.Reader) *http.Request {
+	body := r.Body
+	r = r.WithContext(r.Context())
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(head, body), body}
+	return r
+}
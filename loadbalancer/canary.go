@@ -0,0 +1,75 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// CanaryConfig sends Percent of a pool's requests to the Pool named here
+// instead, independently of the algorithm either pool uses. Seed makes the
+// split reproducible; zero seeds from the clock.
+type CanaryConfig struct {
+	Pool    string  `yaml:"pool"`
+	Percent float64 `yaml:"percent"`
+	Seed    int64   `yaml:"seed"`
+}
+
+func (c CanaryConfig) validate() error {
+	if c.Pool == "" {
+		return fmt.Errorf("pool must not be empty")
+	}
+	if c.Percent < 0 || c.Percent > 100 {
+		return fmt.Errorf("percent must be between 0 and 100, got %g", c.Percent)
+	}
+	return nil
+}
+
+// Splitter diverts a share of a pool's requests to a canary pool. The share
+// can be changed at runtime.
+type Splitter struct {
+	canary *ServerPool
+
+	mu      sync.Mutex
+	rng     *rand.Rand
+	percent float64
+}
+
+func newSplitter(canary *ServerPool, percent float64, seed int64) *Splitter {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &Splitter{
+		canary:  canary,
+		rng:     rand.New(rand.NewSource(seed)),
+		percent: percent,
+	}
+}
+
+// Canary returns the pool that receives the diverted requests.
+func (s *Splitter) Canary() *ServerPool {
+	return s.canary
+}
+
+func (s *Splitter) SetPercent(percent float64) {
+	s.mu.Lock()
+	s.percent = percent
+	s.mu.Unlock()
+}
+
+func (s *Splitter) Percent() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.percent
+}
+
+// divert reports whether the current request should go to the canary pool.
+func (s *Splitter) divert() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.percent <= 0 {
+		return false
+	}
+	return s.rng.Float64()*100 < s.percent
+}
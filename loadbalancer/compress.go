@@ -0,0 +1,222 @@
+package loadbalancer
+
+import (
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// CompressionConfig gzips responses for clients that accept it, when the
+// backend did not compress them already. Responses that would be compressed
+// for such a client carry Vary: Accept-Encoding whether they were or not.
+type CompressionConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// MinSize is the smallest body, in bytes, worth compressing.
+	MinSize int `yaml:"min_size"`
+	// Level is a compress/gzip level from 1 (fastest) to 9 (smallest), or
+	// -1 for the default.
+	Level int `yaml:"level"`
+}
+
+func (c CompressionConfig) validate() error {
+	if c.MinSize < 0 {
+		return fmt.Errorf("min_size must not be negative, got %d", c.MinSize)
+	}
+	if c.Level != gzip.DefaultCompression && (c.Level < gzip.BestSpeed || c.Level > gzip.BestCompression) {
+		return fmt.Errorf("level must be between %d and %d, or %d, got %d", gzip.BestSpeed, gzip.BestCompression, gzip.DefaultCompression, c.Level)
+	}
+	return nil
+}
+
+// incompressibleTypes are content type prefixes whose bodies are already
+// compressed.
+var incompressibleTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/zstd",
+	"application/x-7z-compressed",
+	"application/vnd.rar",
+}
+
+func compressible(contentType string) bool {
+	if strings.HasPrefix(contentType, "image/svg") {
+		return true
+	}
+	for _, prefix := range incompressibleTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, enc := range strings.Split(v, ",") {
+			name, q, _ := strings.Cut(strings.TrimSpace(enc), ";")
+			if strings.EqualFold(strings.TrimSpace(name), "gzip") && strings.ReplaceAll(q, " ", "") != "q=0" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compress gzips the responses of next according to cfg.
+func compress(next http.Handler, cfg CompressionConfig) http.Handler {
+	writers := sync.Pool{New: func() any {
+		w, _ := gzip.NewWriterLevel(nil, cfg.Level)
+		return w
+	}}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead || isUpgrade(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipWriter{ResponseWriter: w, accept: acceptsGzip(r), minSize: cfg.MinSize, pool: &writers}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// gzipWriter holds the start of the body back until it knows whether the
+// response is large enough and of a kind worth compressing. It only
+// compresses if accept is set, the client having asked for gzip.
+type gzipWriter struct {
+	http.ResponseWriter
+	accept  bool
+	minSize int
+	pool    *sync.Pool
+
+	status  int
+	buf     []byte
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (w *gzipWriter) WriteHeader(code int) {
+	if code < http.StatusOK {
+		// Informational responses go out as they are.
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.decided {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) < w.minSize {
+			return len(b), nil
+		}
+		if err := w.start(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// start sends the header, compressing the body if want allows it, and
+// writes out what was held back.
+func (w *gzipWriter) start(want bool) error {
+	w.decided = true
+	h := w.Header()
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if want && w.shouldCompress() {
+		// Whether this response goes out compressed depends on the
+		// client's Accept-Encoding, so caches must keep both apart.
+		addVary(h, "Accept-Encoding")
+		if w.accept {
+			h.Set("Content-Encoding", "gzip")
+			h.Del("Content-Length")
+			w.gz = w.pool.Get().(*gzip.Writer)
+			w.gz.Reset(w.ResponseWriter)
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	if len(w.buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(w.buf)
+	} else {
+		_, err = w.ResponseWriter.Write(w.buf)
+	}
+	w.buf = nil
+	return err
+}
+
+// addVary adds name to the Vary header of h unless it is listed already.
+func addVary(h http.Header, name string) {
+	for _, v := range h.Values("Vary") {
+		for _, token := range strings.Split(v, ",") {
+			if token = strings.TrimSpace(token); token == "*" || strings.EqualFold(token, name) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", name)
+}
+
+func (w *gzipWriter) shouldCompress() bool {
+	h := w.Header()
+	switch {
+	case w.status == http.StatusNoContent, w.status == http.StatusNotModified, w.status == http.StatusPartialContent:
+		return false
+	case h.Get("Content-Encoding") != "", h.Get("Content-Range") != "":
+		return false
+	}
+	return compressible(h.Get("Content-Type"))
+}
+
+// Flush sends a body still held back uncompressed, since a flushing handler
+// wants it delivered now, then flushes.
+func (w *gzipWriter) Flush() {
+	if !w.decided {
+		_ = w.start(len(w.buf) >= w.minSize)
+	}
+	if w.gz != nil {
+		_ = w.gz.Flush()
+	}
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *gzipWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *gzipWriter) close() {
+	if !w.decided {
+		if w.status == 0 {
+			// Nothing was written; leave the response to the server.
+			return
+		}
+		_ = w.start(false)
+	}
+	if w.gz != nil {
+		_ = w.gz.Close()
+		w.pool.Put(w.gz)
+		w.gz = nil
+	}
+}
@@ -0,0 +1,52 @@
+package loadbalancer
+
+import (
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompressVary(t *testing.T) {
+	large := strings.Repeat("a", 2048)
+	cfg := CompressionConfig{Enabled: true, MinSize: 1024, Level: gzip.DefaultCompression}
+	tests := []struct {
+		name     string
+		accept   string
+		body     string
+		vary     string
+		wantGzip bool
+		wantVary []string
+	}{
+		{name: "compressed", accept: "gzip", body: large, wantGzip: true, wantVary: []string{"Accept-Encoding"}},
+		{name: "not accepted", accept: "", body: large, wantVary: []string{"Accept-Encoding"}},
+		{name: "refused", accept: "gzip;q=0", body: large, wantVary: []string{"Accept-Encoding"}},
+		{name: "too small", accept: "gzip", body: "small"},
+		{name: "backend varies", accept: "", body: large, vary: "accept-encoding", wantVary: []string{"accept-encoding"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				if tt.vary != "" {
+					w.Header().Set("Vary", tt.vary)
+				}
+				w.Write([]byte(tt.body))
+			}), cfg)
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept-Encoding", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if gotGzip := w.Header().Get("Content-Encoding") == "gzip"; gotGzip != tt.wantGzip {
+				t.Errorf("compressed = %v, want %v", gotGzip, tt.wantGzip)
+			}
+			if got := w.Header().Values("Vary"); strings.Join(got, ",") != strings.Join(tt.wantVary, ",") {
+				t.Errorf("Vary = %q, want %q", got, tt.wantVary)
+			}
+		})
+	}
+}
@@ -0,0 +1,777 @@
+package loadbalancer
+
+import (
+	"compress/gzip"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config configures a LoadBalancer. It is usually read from a YAML file
+// with LoadConfig.
+type Config struct {
+	Listen string    `yaml:"listen"`
+	TLS    TLSConfig `yaml:"tls"`
+	// ProxyProtocol reads the client address from a PROXY protocol header
+	// on Listen; see ListenerConfig.
+	ProxyProtocol bool `yaml:"proxy_protocol"`
+	// Listeners are further addresses serving the same pools and routes as
+	// Listen, each with its own TLS settings.
+	Listeners []ListenerConfig `yaml:"listeners"`
+	// RedirectHTTP sends plaintext clients over to HTTPS.
+	RedirectHTTP RedirectHTTPConfig `yaml:"redirect_http"`
+	Admin        AdminConfig        `yaml:"admin"`
+	// PoolConfig holds the settings of the pool named "default", which is
+	// built from the top-level backends. Named pools inherit these settings
+	// except for the backends.
+	PoolConfig `yaml:",inline"`
+	// Pools are named pools that routes can send requests to. They are
+	// decoded by LoadConfig on top of the top-level pool settings.
+	Pools  map[string]PoolConfig `yaml:"-"`
+	Routes []RouteConfig         `yaml:"routes"`
+	// Rules route on request headers. They are tried in order and take
+	// precedence over Hosts and Routes.
+	Rules []RuleConfig `yaml:"rules"`
+	// Hosts maps host names to pools. Matching ignores case and the port of
+	// the Host header, and takes precedence over Routes.
+	Hosts map[string]string `yaml:"hosts"`
+	// DefaultPool serves requests that match no host or route. It defaults to the
+	// "default" pool when there are top-level backends; without either,
+	// such requests get a 404.
+	DefaultPool string            `yaml:"default_pool"`
+	Metrics     MetricsConfig     `yaml:"metrics"`
+	AccessLog   AccessLogConfig   `yaml:"access_log"`
+	RequestID   RequestIDConfig   `yaml:"request_id"`
+	Tracing     TracingConfig     `yaml:"tracing"`
+	RateLimit   RateLimitConfig   `yaml:"rate_limit"`
+	Concurrency ConcurrencyConfig `yaml:"concurrency"`
+	Maintenance MaintenanceConfig `yaml:"maintenance"`
+	Compression CompressionConfig `yaml:"compression"`
+	// DebugRouting lets trusted clients send a request to a backend of
+	// their choice. It is off by default.
+	DebugRouting DebugRoutingConfig `yaml:"debug_routing"`
+	// TCP lists raw TCP listeners, each forwarding to one pool.
+	TCP []TCPProxyConfig `yaml:"tcp"`
+	// MaxBodySize rejects requests with a larger body, in bytes, with 413.
+	// Zero means no limit.
+	MaxBodySize int64 `yaml:"max_body_size"`
+	// BodyBuffer keeps request bodies so that retries can resend them.
+	BodyBuffer BodyBufferConfig `yaml:"body_buffer"`
+	// ShutdownTimeout bounds how long in-flight requests may take to finish
+	// after SIGINT or SIGTERM.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// Middleware orders the request pipeline, outermost first. It names
+	// every enabled built-in middleware (request_id, tracing, access_log,
+	// compression and rate_limit) and may name custom ones added with
+	// WithMiddleware. Disabled built-ins in the list are skipped. recover,
+	// first by default, answers requests whose handling panicked with 500;
+	// leaving it out lets such panics reach net/http.
+	Middleware []string `yaml:"middleware"`
+	// ServerTimeouts bound how long clients may take on a connection, on
+	// every listener including the admin API.
+	ServerTimeouts ServerTimeouts `yaml:"server_timeouts"`
+}
+
+// ServerTimeouts are the http.Server timeouts of the same names. Zero
+// leaves one unbounded. ReadHeader defaults to 15s and Idle to 60s, which
+// keeps slow clients from holding connections open; Read and Write are
+// unbounded by default since they also cap large uploads, long downloads and
+// event streams.
+type ServerTimeouts struct {
+	ReadHeader time.Duration `yaml:"read_header"`
+	Read       time.Duration `yaml:"read"`
+	Write      time.Duration `yaml:"write"`
+	Idle       time.Duration `yaml:"idle"`
+}
+
+func (t ServerTimeouts) validate() error {
+	if t.ReadHeader < 0 || t.Read < 0 || t.Write < 0 || t.Idle < 0 {
+		return fmt.Errorf("timeouts must not be negative")
+	}
+	return nil
+}
+
+// Apply sets the timeouts on srv.
+func (t ServerTimeouts) Apply(srv *http.Server) {
+	srv.ReadHeaderTimeout = t.ReadHeader
+	srv.ReadTimeout = t.Read
+	srv.WriteTimeout = t.Write
+	srv.IdleTimeout = t.Idle
+}
+
+// PoolConfig configures a single pool of backends.
+type PoolConfig struct {
+	// Algorithm names the balancing algorithm, see AlgorithmNames. It
+	// defaults to round-robin.
+	Algorithm string `yaml:"algorithm"`
+	// Locality configures the zone-aware algorithm; Zone is required with
+	// it.
+	Locality       LocalityConfig `yaml:"locality"`
+	HealthInterval time.Duration  `yaml:"health_interval"`
+	HealthCheck    HealthCheck    `yaml:"health_check"`
+	// PassiveHealthCheck marks backends down based on proxy errors without
+	// waiting for the next active sweep.
+	PassiveHealthCheck PassiveHealthCheck `yaml:"passive_health_check"`
+	// SlowStart ramps traffic to a recovered backend over this period.
+	SlowStart      time.Duration  `yaml:"slow_start"`
+	CircuitBreaker CircuitBreaker `yaml:"circuit_breaker"`
+	Retry          RetryPolicy    `yaml:"retry"`
+	// RequestTimeout bounds each forwarding attempt; a timed-out attempt
+	// counts as a failure and is retried or failed over. Zero disables it.
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+	// UpstreamTLS configures certificate verification for HTTPS backends.
+	UpstreamTLS UpstreamTLSConfig `yaml:"upstream_tls"`
+	// Transport tunes the connection pool to the backends.
+	Transport TransportConfig `yaml:"transport"`
+	// ForwardedHeaders sets X-Forwarded-For, X-Real-IP, X-Forwarded-Host
+	// and X-Forwarded-Proto on upstream requests. Turn it off behind another
+	// proxy that already sets them; X-Forwarded-For is then not sent at all.
+	ForwardedHeaders bool `yaml:"forwarded_headers"`
+	// DebugHeaders adds X-LB-Backend, X-LB-Attempts and X-LB-Retries to
+	// responses, telling which backend served the request, how many
+	// backends were tried and how often the last one was retried. Keep it
+	// off in production.
+	DebugHeaders bool `yaml:"debug_headers"`
+	// ErrorPage customizes the 502, 503 and 504 responses of this pool. The
+	// top-level setting also applies to 404, 429 and concurrency limit
+	// responses.
+	ErrorPage ErrorPage `yaml:"error_page"`
+	// MaskErrors hides the body of backend error responses behind the
+	// error page. Masks are tried in order; none are set by default.
+	MaskErrors []ErrorMask `yaml:"mask_errors"`
+	// Sticky pins clients to a backend by cookie, header or consistent
+	// hash. Sessions are not sticky by default.
+	Sticky *StickyConfig `yaml:"sticky"`
+	// Canary diverts a share of this pool's requests to another pool. It is
+	// not inherited by named pools.
+	Canary *CanaryConfig `yaml:"canary"`
+	// Mirror copies a share of this pool's requests to a shadow backend.
+	// It is not inherited by named pools.
+	Mirror   *MirrorConfig   `yaml:"mirror"`
+	Backends []BackendConfig `yaml:"backends"`
+	// Discovery adds backends found in a service registry to Backends. Like
+	// Backends, it is not inherited by named pools.
+	Discovery *DiscoveryConfig `yaml:"discovery"`
+}
+
+// RouteConfig sends requests whose path starts with Prefix to the named pool.
+type RouteConfig struct {
+	Prefix string `yaml:"prefix"`
+	Pool   string `yaml:"pool"`
+	// MaxBodySize overrides the top-level max_body_size for this route.
+	MaxBodySize int64 `yaml:"max_body_size"`
+}
+
+// RuleConfig sends requests whose Header equals Value, or matches the
+// regular expression Regex, to Pool. Exactly one of Value and Regex is set.
+type RuleConfig struct {
+	Header string `yaml:"header"`
+	Value  string `yaml:"value"`
+	Regex  string `yaml:"regex"`
+	Pool   string `yaml:"pool"`
+}
+
+func (rc RuleConfig) validate() error {
+	if rc.Header == "" {
+		return fmt.Errorf("header is required")
+	}
+	if (rc.Value == "") == (rc.Regex == "") {
+		return fmt.Errorf("exactly one of value and regex is required")
+	}
+	if rc.Regex != "" {
+		if _, err := regexp.Compile(rc.Regex); err != nil {
+			return fmt.Errorf("regex: %w", err)
+		}
+	}
+	return nil
+}
+
+// defaultPoolName is the name of the pool built from the top-level backends.
+const defaultPoolName = "default"
+
+// AdminConfig configures the admin API listener, which is disabled when
+// Listen is empty. Its TLS settings are independent of the proxy listener's.
+type AdminConfig struct {
+	Listen string          `yaml:"listen"`
+	TLS    TLSConfig       `yaml:"tls"`
+	Auth   AdminAuthConfig `yaml:"auth"`
+}
+
+// ListenerConfig is an address the load balancer accepts requests on.
+type ListenerConfig struct {
+	Listen string    `yaml:"listen"`
+	TLS    TLSConfig `yaml:"tls"`
+	// ProxyProtocol expects every connection to start with a PROXY
+	// protocol header, v1 or v2, and takes the client address from it.
+	// Only enable it behind a balancer that sends one, such as an AWS NLB;
+	// connections without a header are closed.
+	ProxyProtocol bool `yaml:"proxy_protocol"`
+}
+
+// AllListeners returns Listen, with TLS and ProxyProtocol, followed by
+// Listeners.
+func (c Config) AllListeners() []ListenerConfig {
+	return append([]ListenerConfig{{Listen: c.Listen, TLS: c.TLS, ProxyProtocol: c.ProxyProtocol}}, c.Listeners...)
+}
+
+type BackendConfig struct {
+	URL    string `yaml:"url"`
+	Weight *int   `yaml:"weight"`
+	// Priority is the backend's failover tier. Backends with a higher
+	// priority only take traffic while every backend of lower priority is
+	// down.
+	Priority int `yaml:"priority"`
+	// Tags are free-form labels, such as zone or version, shown in the
+	// status API and exported on lb_backend_info.
+	Tags map[string]string `yaml:"tags"`
+	// MaxConns caps the requests in flight to this backend; zero means no cap.
+	MaxConns int `yaml:"max_conns"`
+	// Timeout overrides the global request_timeout for this backend.
+	Timeout time.Duration `yaml:"timeout"`
+	// TLS overrides the global upstream_tls settings for this backend.
+	TLS *UpstreamTLSConfig `yaml:"tls"`
+	// HostHeader is "preserve" (the default) to pass the client's Host
+	// header on, or "backend" to replace it with the backend's host, as
+	// virtual-hosted upstreams need.
+	HostHeader string `yaml:"host_header"`
+	// Rewrite changes the request path before it is sent to the backend.
+	Rewrite PathRewrite `yaml:"rewrite"`
+	// HealthCheck overrides the pool's health_check for this backend.
+	HealthCheck *HealthCheckOverride `yaml:"health_check"`
+}
+
+// DefaultConfig returns the configuration used for settings a config file
+// leaves out.
+func DefaultConfig() Config {
+	return Config{
+		Listen: ":8080",
+		RedirectHTTP: RedirectHTTPConfig{
+			Status: http.StatusMovedPermanently,
+		},
+		PoolConfig: PoolConfig{
+			Algorithm: "round-robin",
+			Locality: LocalityConfig{
+				Key:       "zone",
+				Spillover: SpilloverDown,
+			},
+			HealthInterval: 30 * time.Second,
+			HealthCheck:    defaultHealthCheck(),
+			PassiveHealthCheck: PassiveHealthCheck{
+				MaxFailures: 5,
+				Window:      10 * time.Second,
+			},
+			SlowStart: 30 * time.Second,
+			CircuitBreaker: CircuitBreaker{
+				Cooldown:    10 * time.Second,
+				MaxCooldown: 5 * time.Minute,
+			},
+			Retry:            defaultRetryPolicy(),
+			Transport:        defaultTransportConfig(),
+			ForwardedHeaders: true,
+			Backends: []BackendConfig{
+				{URL: "http://localhost:8081"},
+				{URL: "http://localhost:8082"},
+				{URL: "http://localhost:8083"},
+			},
+		},
+		Metrics: defaultMetricsConfig(),
+		AccessLog: AccessLogConfig{
+			Format: AccessLogStructured,
+		},
+		RequestID: RequestIDConfig{
+			Header:   "X-Request-ID",
+			Generate: true,
+		},
+		Tracing: TracingConfig{
+			Endpoint:    "localhost:4318",
+			Insecure:    true,
+			ServiceName: "goloadbalancer",
+			SampleRatio: 1,
+		},
+		RateLimit: RateLimitConfig{
+			IdleTimeout: 5 * time.Minute,
+		},
+		Compression: CompressionConfig{
+			MinSize: 1024,
+			Level:   gzip.DefaultCompression,
+		},
+		DebugRouting: DebugRoutingConfig{
+			Header: "X-LB-Backend",
+		},
+		BodyBuffer: BodyBufferConfig{
+			MemoryLimit: 1 << 20,
+		},
+		ShutdownTimeout: 30 * time.Second,
+		Middleware:      defaultMiddleware(),
+		ServerTimeouts: ServerTimeouts{
+			ReadHeader: 15 * time.Second,
+			Idle:       60 * time.Second,
+		},
+	}
+}
+
+// LoadConfig reads the YAML file at path on top of the defaults. Fields left
+// out of the file keep their default value. An empty path yields the
+// defaults. override, if not nil, is applied before the named pools inherit
+// the top-level settings, so command-line flags take precedence over the
+// file everywhere except where a pool sets a value itself.
+func LoadConfig(path string, override func(*Config)) (Config, error) {
+	cfg := DefaultConfig()
+	var raw struct {
+		Backends  yaml.Node            `yaml:"backends"`
+		Discovery yaml.Node            `yaml:"discovery"`
+		Pools     map[string]yaml.Node `yaml:"pools"`
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, err
+		}
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		if err := yaml.Unmarshal(data, &raw); err != nil {
+			return cfg, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		// A file that only defines named pools, or discovers its backends,
+		// does not get the default backends as well.
+		if (len(raw.Pools) > 0 || raw.Discovery.Kind != 0) && raw.Backends.Kind == 0 {
+			cfg.Backends = nil
+		}
+	}
+	cfg.Admin.Auth.fromEnv()
+	if override != nil {
+		override(&cfg)
+	}
+	if len(raw.Pools) > 0 {
+		cfg.Pools = make(map[string]PoolConfig, len(raw.Pools))
+	}
+	for name, node := range raw.Pools {
+		pc := cfg.PoolConfig
+		pc.Backends, pc.Canary, pc.Mirror, pc.Discovery = nil, nil, nil, nil
+		if err := node.Decode(&pc); err != nil {
+			return cfg, fmt.Errorf("parsing %s: pools.%s: %w", path, name, err)
+		}
+		cfg.Pools[name] = pc
+	}
+	return cfg, cfg.validate()
+}
+
+// hasBackends reports whether c configures or discovers any backends.
+func (c PoolConfig) hasBackends() bool {
+	return len(c.Backends) > 0 || c.Discovery != nil
+}
+
+// pools returns the configuration of every pool by name, including the
+// default pool when there are top-level backends.
+func (c Config) pools() map[string]PoolConfig {
+	pools := make(map[string]PoolConfig, len(c.Pools)+1)
+	if c.hasBackends() {
+		pools[defaultPoolName] = c.PoolConfig
+	}
+	for name, pc := range c.Pools {
+		pools[name] = pc
+	}
+	return pools
+}
+
+func (c Config) defaultPool() string {
+	if c.DefaultPool == "" && c.hasBackends() {
+		return defaultPoolName
+	}
+	return c.DefaultPool
+}
+
+func (c Config) validate() error {
+	if c.Listen == "" {
+		return fmt.Errorf("listen address must not be empty")
+	}
+	if err := c.TLS.validate(); err != nil {
+		return fmt.Errorf("tls: %w", err)
+	}
+	seen := map[string]bool{c.Listen: true}
+	for i, l := range c.Listeners {
+		if l.Listen == "" {
+			return fmt.Errorf("listeners[%d]: listen address must not be empty", i)
+		}
+		if seen[l.Listen] {
+			return fmt.Errorf("listeners[%d]: duplicate listen address %q", i, l.Listen)
+		}
+		seen[l.Listen] = true
+		if err := l.TLS.validate(); err != nil {
+			return fmt.Errorf("listeners[%d].tls: %w", i, err)
+		}
+	}
+	if err := c.RedirectHTTP.validate(); err != nil {
+		return fmt.Errorf("redirect_http: %w", err)
+	}
+	if c.RedirectHTTP.Listen != "" {
+		if seen[c.RedirectHTTP.Listen] {
+			return fmt.Errorf("redirect_http: listen address %q is already serving the load balancer", c.RedirectHTTP.Listen)
+		}
+		if c.RedirectPort() == "" {
+			return fmt.Errorf("redirect_http: no listener has tls enabled; set port")
+		}
+	}
+	if err := c.Admin.TLS.validate(); err != nil {
+		return fmt.Errorf("admin.tls: %w", err)
+	}
+	if c.Admin.Listen != "" {
+		if err := c.Admin.Auth.validate(); err != nil {
+			return fmt.Errorf("admin.auth: %w", err)
+		}
+	}
+	for i, bound := range c.Metrics.LatencyBuckets {
+		if i > 0 && bound <= c.Metrics.LatencyBuckets[i-1] {
+			return fmt.Errorf("metrics: latency_buckets must be strictly increasing")
+		}
+	}
+	if err := c.AccessLog.validate(); err != nil {
+		return fmt.Errorf("access_log: %w", err)
+	}
+	if err := c.RequestID.validate(); err != nil {
+		return fmt.Errorf("request_id: %w", err)
+	}
+	if err := c.Tracing.validate(); err != nil {
+		return fmt.Errorf("tracing: %w", err)
+	}
+	if err := c.RateLimit.validate(); err != nil {
+		return fmt.Errorf("rate_limit: %w", err)
+	}
+	if err := c.Concurrency.validate(); err != nil {
+		return fmt.Errorf("concurrency: %w", err)
+	}
+	if c.ShutdownTimeout <= 0 {
+		return fmt.Errorf("shutdown_timeout must be positive, got %s", c.ShutdownTimeout)
+	}
+	if err := c.ServerTimeouts.validate(); err != nil {
+		return fmt.Errorf("server_timeouts: %w", err)
+	}
+	if err := c.validateMiddleware(); err != nil {
+		return fmt.Errorf("middleware: %w", err)
+	}
+	if _, ok := c.Pools[defaultPoolName]; ok && c.hasBackends() {
+		return fmt.Errorf("pools: name %q is taken by the top-level backends", defaultPoolName)
+	}
+	pools := c.pools()
+	if len(pools) == 0 {
+		return fmt.Errorf("no backends configured")
+	}
+	if c.hasBackends() {
+		if err := c.PoolConfig.validate(); err != nil {
+			return err
+		}
+	}
+	for name, pc := range c.Pools {
+		if err := pc.validate(); err != nil {
+			return fmt.Errorf("pools.%s: %w", name, err)
+		}
+	}
+	for name, pc := range pools {
+		if pc.Canary == nil {
+			continue
+		}
+		prefix := "canary"
+		if name != defaultPoolName || !c.hasBackends() {
+			prefix = "pools." + name + ".canary"
+		}
+		if err := pc.Canary.validate(); err != nil {
+			return fmt.Errorf("%s: %w", prefix, err)
+		}
+		if _, ok := pools[pc.Canary.Pool]; !ok || pc.Canary.Pool == name {
+			return fmt.Errorf("%s: invalid pool %q", prefix, pc.Canary.Pool)
+		}
+	}
+	for i, route := range c.Routes {
+		if !strings.HasPrefix(route.Prefix, "/") {
+			return fmt.Errorf("routes[%d]: prefix must start with /, got %q", i, route.Prefix)
+		}
+		if _, ok := pools[route.Pool]; !ok {
+			return fmt.Errorf("routes[%d]: unknown pool %q", i, route.Pool)
+		}
+		if route.MaxBodySize < 0 {
+			return fmt.Errorf("routes[%d]: max_body_size must not be negative, got %d", i, route.MaxBodySize)
+		}
+	}
+	if c.MaxBodySize < 0 {
+		return fmt.Errorf("max_body_size must not be negative, got %d", c.MaxBodySize)
+	}
+	if err := c.BodyBuffer.validate(); err != nil {
+		return fmt.Errorf("body_buffer: %w", err)
+	}
+	if err := c.Compression.validate(); err != nil {
+		return fmt.Errorf("compression: %w", err)
+	}
+	if err := c.DebugRouting.validate(); err != nil {
+		return fmt.Errorf("debug_routing: %w", err)
+	}
+	for i, rule := range c.Rules {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("rules[%d]: %w", i, err)
+		}
+		if _, ok := pools[rule.Pool]; !ok {
+			return fmt.Errorf("rules[%d]: unknown pool %q", i, rule.Pool)
+		}
+	}
+	for host, pool := range c.Hosts {
+		if host == "" {
+			return fmt.Errorf("hosts: host name must not be empty")
+		}
+		if _, ok := pools[pool]; !ok {
+			return fmt.Errorf("hosts.%s: unknown pool %q", host, pool)
+		}
+	}
+	for i, tc := range c.TCP {
+		if err := tc.validate(); err != nil {
+			return fmt.Errorf("tcp[%d]: %w", i, err)
+		}
+		if _, ok := pools[tc.Pool]; !ok {
+			return fmt.Errorf("tcp[%d]: unknown pool %q", i, tc.Pool)
+		}
+	}
+	if name := c.defaultPool(); name != "" {
+		if _, ok := pools[name]; !ok {
+			return fmt.Errorf("default_pool: unknown pool %q", name)
+		}
+	}
+	return nil
+}
+
+func (c PoolConfig) validate() error {
+	if _, err := NewAlgorithm(c.Algorithm); err != nil {
+		return err
+	}
+	if err := c.Locality.validate(); err != nil {
+		return fmt.Errorf("locality: %w", err)
+	}
+	if err := c.Mirror.validate(); err != nil {
+		return fmt.Errorf("mirror: %w", err)
+	}
+	if err := c.Sticky.validate(); err != nil {
+		return fmt.Errorf("sticky: %w", err)
+	}
+	if c.Algorithm == "zone-aware" && c.Locality.Zone == "" {
+		return fmt.Errorf("locality: zone is required by the zone-aware algorithm")
+	}
+	if c.HealthInterval <= 0 {
+		return fmt.Errorf("health_interval must be positive, got %s", c.HealthInterval)
+	}
+	if _, err := c.UpstreamTLS.build(); err != nil {
+		return fmt.Errorf("upstream_tls: %w", err)
+	}
+	if err := c.Transport.validate(); err != nil {
+		return fmt.Errorf("transport: %w", err)
+	}
+	if err := c.HealthCheck.validate(); err != nil {
+		return fmt.Errorf("health_check: %w", err)
+	}
+	if c.PassiveHealthCheck.MaxFailures < 0 {
+		return fmt.Errorf("passive_health_check: max_failures must not be negative, got %d", c.PassiveHealthCheck.MaxFailures)
+	}
+	if c.SlowStart < 0 {
+		return fmt.Errorf("slow_start must not be negative, got %s", c.SlowStart)
+	}
+	if cb := c.CircuitBreaker; cb.MaxFailures > 0 && cb.Cooldown <= 0 {
+		return fmt.Errorf("circuit_breaker: cooldown must be positive, got %s", cb.Cooldown)
+	}
+	if c.RequestTimeout < 0 {
+		return fmt.Errorf("request_timeout must not be negative, got %s", c.RequestTimeout)
+	}
+	for i, m := range c.MaskErrors {
+		if err := m.validate(); err != nil {
+			return fmt.Errorf("mask_errors[%d]: %w", i, err)
+		}
+	}
+	if err := c.Retry.validate(); err != nil {
+		return fmt.Errorf("retry: %w", err)
+	}
+	if !c.hasBackends() {
+		return fmt.Errorf("no backends configured")
+	}
+	if err := c.Discovery.validate(); err != nil {
+		return fmt.Errorf("discovery: %w", err)
+	}
+	for i, b := range c.Backends {
+		if _, err := b.parseURL(); err != nil {
+			return fmt.Errorf("backends[%d]: %w", i, err)
+		}
+		if b.Weight != nil && *b.Weight < 0 {
+			return fmt.Errorf("backends[%d]: weight must not be negative, got %d", i, *b.Weight)
+		}
+		for k := range b.Tags {
+			if k == "" {
+				return fmt.Errorf("backends[%d]: tag names must not be empty", i)
+			}
+		}
+		if b.Priority < 0 {
+			return fmt.Errorf("backends[%d]: priority must not be negative, got %d", i, b.Priority)
+		}
+		if b.MaxConns < 0 {
+			return fmt.Errorf("backends[%d]: max_conns must not be negative, got %d", i, b.MaxConns)
+		}
+		if b.Timeout < 0 {
+			return fmt.Errorf("backends[%d]: timeout must not be negative, got %s", i, b.Timeout)
+		}
+		switch b.HostHeader {
+		case "", HostHeaderPreserve, HostHeaderBackend:
+		default:
+			return fmt.Errorf("backends[%d]: unknown host_header %q, want %q or %q", i, b.HostHeader, HostHeaderPreserve, HostHeaderBackend)
+		}
+		if err := b.Rewrite.validate(); err != nil {
+			return fmt.Errorf("backends[%d]: rewrite: %w", i, err)
+		}
+		if err := b.HealthCheck.validate(c.HealthCheck); err != nil {
+			return fmt.Errorf("backends[%d]: health_check: %w", i, err)
+		}
+		if b.TLS != nil {
+			if _, err := b.TLS.build(); err != nil {
+				return fmt.Errorf("backends[%d]: tls: %w", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (b BackendConfig) parseURL() (*url.URL, error) {
+	return parseBackendURL(b.URL)
+}
+
+func (b BackendConfig) weight() int {
+	if b.Weight == nil {
+		return 1
+	}
+	return *b.Weight
+}
+
+// configure applies the per-backend settings from bc to b. It reports
+// whether b's weight changed.
+func (bc BackendConfig) configure(b *Backend) (weightChanged bool, err error) {
+	weightChanged = b.setConfiguredWeight(bc.weight())
+	b.SetPriority(bc.Priority)
+	b.SetTags(bc.Tags)
+	b.SetMaxConns(int64(bc.MaxConns))
+	b.SetTimeout(bc.Timeout)
+	b.SetRewriteHost(bc.HostHeader == HostHeaderBackend)
+	b.SetPathRewrite(bc.Rewrite)
+	b.SetHealthCheck(bc.HealthCheck)
+	return weightChanged, b.SetUpstreamTLS(bc.TLS)
+}
+
+// reconcileBackends makes the pool match the configured backends: unknown
+// backends are added, backends missing from the config are removed and the
+// settings of the rest are updated. Backends that stay keep their alive
+// status and in-flight requests. Backends added through the admin API are
+// only removed through it, unless the config takes them over by listing
+// them.
+func reconcileBackends(pool *ServerPool, configs []BackendConfig) error {
+	wanted := make(map[string]BackendConfig, len(configs))
+	for _, bc := range configs {
+		u, err := bc.parseURL()
+		if err != nil {
+			return err
+		}
+		wanted[backendKey(u)] = bc
+	}
+
+	for _, b := range pool.Backends() {
+		bc, ok := wanted[backendKey(b.url)]
+		if !ok {
+			if b.isAdminAdded() {
+				continue
+			}
+			pool.RemoveBackend(b.url)
+			slog.Info("removed server", "pool", pool.name, "backend", b.url.String())
+			continue
+		}
+		b.setAdminAdded(false)
+		changed, err := bc.configure(b)
+		if err != nil {
+			return fmt.Errorf("%s: %w", b.url, err)
+		}
+		if changed {
+			slog.Info("updated server", "pool", pool.name, "backend", b.url.String(), "weight", b.Weight())
+		}
+		delete(wanted, backendKey(b.url))
+	}
+
+	for _, bc := range configs {
+		u, _ := bc.parseURL()
+		key := backendKey(u)
+		if _, ok := wanted[key]; !ok {
+			continue
+		}
+		delete(wanted, key)
+		b := newBackend(u, pool)
+		if _, err := bc.configure(b); err != nil {
+			return fmt.Errorf("%s: %w", u, err)
+		}
+		pool.AddBackend(b)
+		slog.Info("configured server", "pool", pool.name, "backend", u.String())
+	}
+	return nil
+}
+
+// apply pushes the pool-level settings of c into pool and reconciles its
+// backends. The discovered backends are looked up unless noDiscovery is set.
+func (c PoolConfig) apply(pool *ServerPool, noDiscovery bool) error {
+	// Keeping the running algorithm preserves its state, like round-robin
+	// position or latency averages, across reloads.
+	if c.Algorithm != pool.AlgorithmName() {
+		algo, err := NewAlgorithm(c.Algorithm)
+		if err != nil {
+			return err
+		}
+		if za, ok := algo.(*ZoneAware); ok {
+			za.SetLocality(c.Locality)
+		}
+		pool.setAlgorithm(algo, c.Algorithm)
+	} else if za, ok := pool.Algorithm().(*ZoneAware); ok {
+		za.SetLocality(c.Locality)
+	}
+	pool.SetHealthInterval(c.HealthInterval)
+	pool.SetHealthCheck(c.HealthCheck)
+	pool.SetPassiveHealthCheck(c.PassiveHealthCheck)
+	pool.SetSlowStart(c.SlowStart)
+	pool.SetCircuitBreaker(c.CircuitBreaker)
+	pool.SetRetryPolicy(c.Retry)
+	pool.SetRequestTimeout(c.RequestTimeout)
+	pool.SetForwardedHeaders(c.ForwardedHeaders)
+	pool.SetDebugHeaders(c.DebugHeaders)
+	pool.SetErrorPage(c.ErrorPage)
+	pool.SetErrorMasks(c.MaskErrors)
+	pool.SetMirror(c.Mirror)
+	pool.SetStickySessions(c.Sticky.sessions())
+	if err := pool.SetTransportConfig(c.Transport); err != nil {
+		return fmt.Errorf("transport: %w", err)
+	}
+	if err := pool.SetUpstreamTLS(c.UpstreamTLS); err != nil {
+		return fmt.Errorf("upstream_tls: %w", err)
+	}
+	var interval time.Duration
+	if c.Discovery != nil {
+		interval = c.Discovery.Interval
+	}
+	return pool.setDiscovery(c.Discovery.discoverer(), interval, c.Backends, !noDiscovery)
+}
+
+// splitterFor returns the splitter pool should use for c. The current
+// splitter is kept, with the configured percentage, while it still points at
+// the same canary pool so that its random sequence carries on.
+func splitterFor(pool *ServerPool, c *CanaryConfig, pools map[string]*ServerPool) *Splitter {
+	if c == nil {
+		return nil
+	}
+	canary := pools[c.Pool]
+	if sp := pool.Splitter(); sp != nil && sp.Canary() == canary {
+		sp.SetPercent(c.Percent)
+		return sp
+	}
+	return newSplitter(canary, c.Percent, c.Seed)
+}
@@ -0,0 +1,32 @@
+package loadbalancer
+
+import "testing"
+
+func TestReconcileKeepsAdminWeight(t *testing.T) {
+	pool := NewServerPool()
+	weight := func(w int) []BackendConfig {
+		return []BackendConfig{{URL: "http://10.0.0.1:80", Weight: &w}}
+	}
+	if err := reconcileBackends(pool, weight(2)); err != nil {
+		t.Fatal(err)
+	}
+	b := pool.Backends()[0]
+
+	// An admin change survives reconciling the same configuration again,
+	// as every discovery round does.
+	b.SetWeight(7)
+	if err := reconcileBackends(pool, weight(2)); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.Weight(); got != 7 {
+		t.Fatalf("weight after reconciling an unchanged config = %d, want 7", got)
+	}
+
+	// A new configured weight replaces it.
+	if err := reconcileBackends(pool, weight(3)); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.Weight(); got != 3 {
+		t.Fatalf("weight after changing the config = %d, want 3", got)
+	}
+}
@@ -0,0 +1,130 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+const defaultConsulAddress = "http://127.0.0.1:8500"
+
+// ConsulConfig looks backends up in the Consul catalog: every instance of
+// Service whose Consul health checks pass, optionally only those with Tag.
+// Address defaults to the local agent and Token to the CONSUL_HTTP_TOKEN
+// environment variable.
+type ConsulConfig struct {
+	Address    string `yaml:"address"`
+	Service    string `yaml:"service"`
+	Tag        string `yaml:"tag"`
+	Datacenter string `yaml:"datacenter"`
+	Token      string `yaml:"token"`
+	// Scheme is how instances are reached, http by default.
+	Scheme string `yaml:"scheme"`
+}
+
+func (c ConsulConfig) validate() error {
+	if c.Service == "" {
+		return fmt.Errorf("consul: service is required")
+	}
+	if c.Address != "" {
+		if u, err := url.Parse(c.Address); err != nil || u.Host == "" {
+			return fmt.Errorf("consul: invalid address %q", c.Address)
+		}
+	}
+	return nil
+}
+
+// ConsulDiscovery resolves backends from Consul's health endpoint, so only
+// instances passing their Consul checks are returned. An instance's passing
+// weight becomes the backend's weight and its service metadata the
+// backend's tags.
+type ConsulDiscovery struct {
+	Address    string
+	Service    string
+	Tag        string
+	Datacenter string
+	Token      string
+	Scheme     string
+}
+
+// consulEntry is the part of a /v1/health/service entry that is used.
+type consulEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+		Meta    map[string]string
+		Weights struct {
+			Passing int
+		}
+	}
+}
+
+func (d ConsulDiscovery) Discover(ctx context.Context) ([]BackendConfig, error) {
+	address := d.Address
+	if address == "" {
+		address = defaultConsulAddress
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	u = u.JoinPath("v1/health/service", d.Service)
+	q := url.Values{"passing": {"true"}}
+	if d.Tag != "" {
+		q.Set("tag", d.Tag)
+	}
+	if d.Datacenter != "" {
+		q.Set("dc", d.Datacenter)
+	}
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	token := d.Token
+	if token == "" {
+		token = os.Getenv("CONSUL_HTTP_TOKEN")
+	}
+	if token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("consul returned status %d", resp.StatusCode)
+	}
+	var entries []consulEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("decoding consul response: %w", err)
+	}
+
+	scheme := d.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	backends := make([]BackendConfig, 0, len(entries))
+	for _, e := range entries {
+		host := e.Service.Address
+		if host == "" {
+			host = e.Node.Address
+		}
+		weight := max(e.Service.Weights.Passing, 1)
+		backends = append(backends, BackendConfig{
+			URL:    scheme + "://" + net.JoinHostPort(host, strconv.Itoa(e.Service.Port)),
+			Weight: &weight,
+			Tags:   e.Service.Meta,
+		})
+	}
+	return backends, nil
+}
@@ -0,0 +1,87 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// DebugRoutingConfig lets clients from AllowedIPs pick the backend of their
+// request by setting Header, X-LB-Backend by default, to its URL, bypassing
+// the algorithm, stickiness and failover to other backends. The header is
+// removed before the request is forwarded, and ignored from any other
+// address. A URL that is not in the pool the request is routed to gets 421,
+// a backend that is down or full 503. A forced request that still fails
+// after its retries gets 502, or 504 when it timed out, and leaves the
+// backend up.
+type DebugRoutingConfig struct {
+	Enabled    bool     `yaml:"enabled"`
+	Header     string   `yaml:"header"`
+	AllowedIPs []string `yaml:"allowed_ips"`
+}
+
+func (c DebugRoutingConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Header == "" {
+		return fmt.Errorf("header must not be empty")
+	}
+	if len(c.AllowedIPs) == 0 {
+		return fmt.Errorf("allowed_ips is required")
+	}
+	_, err := parseAllowedIPs(c.AllowedIPs)
+	return err
+}
+
+// debugRouting is the compiled form of a DebugRoutingConfig.
+type debugRouting struct {
+	header  string
+	allowed []*net.IPNet
+}
+
+func newDebugRouting(c DebugRoutingConfig) *debugRouting {
+	if !c.Enabled {
+		return nil
+	}
+	allowed, _ := parseAllowedIPs(c.AllowedIPs)
+	return &debugRouting{header: c.Header, allowed: allowed}
+}
+
+type forcedBackendKey struct{}
+
+func forcedBackendFrom(r *http.Request) *Backend {
+	b, _ := r.Context().Value(forcedBackendKey{}).(*Backend)
+	return b
+}
+
+// route pins r to the backend of pool its header names, if any. It replies
+// and returns false when that backend cannot serve the request.
+func (d *debugRouting) route(w http.ResponseWriter, r *http.Request, pool *ServerPool) (*http.Request, bool) {
+	target := r.Header.Get(d.header)
+	if target == "" {
+		return r, true
+	}
+	r.Header.Del(d.header)
+	if !remoteIPAllowed(r, d.allowed) {
+		slog.Debug("ignoring backend override from untrusted address", "remote_addr", r.RemoteAddr, "header", d.header)
+		return r, true
+	}
+	var b *Backend
+	if u, err := url.Parse(target); err == nil {
+		b = pool.GetBackend(u)
+	}
+	switch {
+	case b == nil:
+		pool.ErrorPage().write(w, http.StatusMisdirectedRequest, fmt.Sprintf("Backend %s is not in pool %s", target, pool.name))
+		return r, false
+	case !b.IsAlive():
+		pool.ErrorPage().write(w, http.StatusServiceUnavailable, fmt.Sprintf("Backend %s is down", target))
+		return r, false
+	}
+	slog.Info("backend override", "remote_addr", r.RemoteAddr, "path", r.URL.Path, "pool", pool.name, "backend", b.url.String())
+	return r.WithContext(context.WithValue(r.Context(), forcedBackendKey{}, b)), true
+}
@@ -0,0 +1,48 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestForcedBackendDoesNotFailOver(t *testing.T) {
+	var served atomic.Int64
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served.Add(1)
+	}))
+	defer up.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	lb, srv := newTestLB(t, []string{up.URL, down.URL}, func(c *Config) {
+		c.Retry.Retries = 1
+		c.Retry.BaseDelay = time.Millisecond
+		c.DebugRouting.Enabled = true
+		c.DebugRouting.AllowedIPs = []string{"127.0.0.1", "::1"}
+	})
+	req, err := http.NewRequest("GET", srv.URL+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-LB-Backend", down.URL)
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502", resp.StatusCode)
+	}
+	if n := served.Load(); n != 0 {
+		t.Errorf("request failed over to another backend %d times", n)
+	}
+	for _, b := range lb.Router().DefaultPool().Backends() {
+		if !b.IsAlive() {
+			t.Errorf("%s marked down by a forced request", b.url)
+		}
+	}
+}
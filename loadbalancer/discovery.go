@@ -0,0 +1,270 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultDiscoveryInterval is the time between lookups when none is
+	// configured.
+	defaultDiscoveryInterval = 30 * time.Second
+	// discoveryTimeout bounds a single lookup of a pool's backends.
+	discoveryTimeout = 10 * time.Second
+)
+
+// Discoverer finds a pool's backends in a service registry. Implementations
+// must be comparable, so that a reload with the same source keeps the
+// backends already found.
+type Discoverer interface {
+	Discover(ctx context.Context) ([]BackendConfig, error)
+}
+
+// DiscoveryConfig adds backends found in a service registry to the
+// configured ones, refreshing them every Interval, 30s by default. Exactly
+// one source is set.
+type DiscoveryConfig struct {
+	Interval time.Duration `yaml:"interval"`
+	DNSSRV   *DNSSRVConfig `yaml:"dns_srv"`
+	Consul   *ConsulConfig `yaml:"consul"`
+}
+
+func (c *DiscoveryConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.Interval < 0 {
+		return fmt.Errorf("interval must not be negative, got %s", c.Interval)
+	}
+	switch {
+	case c.DNSSRV != nil && c.Consul != nil:
+		return fmt.Errorf("dns_srv and consul are mutually exclusive")
+	case c.DNSSRV != nil:
+		return c.DNSSRV.validate()
+	case c.Consul != nil:
+		return c.Consul.validate()
+	}
+	return fmt.Errorf("a source is required, dns_srv or consul")
+}
+
+func (c *DiscoveryConfig) discoverer() Discoverer {
+	switch {
+	case c == nil:
+		return nil
+	case c.Consul != nil:
+		return ConsulDiscovery(*c.Consul)
+	}
+	return SRVDiscovery{Name: c.DNSSRV.Name, Scheme: c.DNSSRV.Scheme}
+}
+
+// DNSSRVConfig looks backends up in the SRV records of Name, such as
+// _http._tcp.api.example.com, and reaches them over Scheme, http by
+// default.
+type DNSSRVConfig struct {
+	Name   string `yaml:"name"`
+	Scheme string `yaml:"scheme"`
+}
+
+func (c DNSSRVConfig) validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("dns_srv: name is required")
+	}
+	return nil
+}
+
+// SRVDiscovery resolves backends from DNS SRV records. Each record's
+// priority becomes the backend's priority and its weight the backend's
+// weight, with weight 0 raised to 1 since a zero weight takes a backend out
+// of rotation here but not in SRV.
+type SRVDiscovery struct {
+	Name   string
+	Scheme string
+}
+
+func (d SRVDiscovery) Discover(ctx context.Context) ([]BackendConfig, error) {
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", d.Name)
+	if err != nil {
+		return nil, err
+	}
+	scheme := d.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	backends := make([]BackendConfig, 0, len(records))
+	for _, rec := range records {
+		host := strings.TrimSuffix(rec.Target, ".")
+		weight := max(int(rec.Weight), 1)
+		backends = append(backends, BackendConfig{
+			URL:      scheme + "://" + net.JoinHostPort(host, strconv.Itoa(int(rec.Port))),
+			Weight:   &weight,
+			Priority: int(rec.Priority),
+		})
+	}
+	return backends, nil
+}
+
+// WithoutDiscovery configures pools without looking up their discovered
+// backends right away, so they hold just the static ones until the
+// discovery loop's first tick after Start. It lets a config be checked
+// without waiting on its service registries.
+func WithoutDiscovery() NewOption {
+	return func(o *newOptions) {
+		o.noDiscovery = true
+	}
+}
+
+// SetDiscovery makes the pool add the backends d finds to static, the
+// configured ones, looking them up again every interval once
+// StartDiscovery has been called. A nil d leaves just the static backends.
+// Setting the same d again keeps the backends it found last.
+func (s *ServerPool) SetDiscovery(d Discoverer, interval time.Duration, static []BackendConfig) error {
+	return s.setDiscovery(d, interval, static, true)
+}
+
+// setDiscovery is SetDiscovery. A new d is only looked up right away if
+// lookup is set; otherwise the discovery loop adds its backends.
+func (s *ServerPool) setDiscovery(d Discoverer, interval time.Duration, static []BackendConfig, lookup bool) error {
+	s.mu.Lock()
+	changed := d != s.discoverer
+	reset := changed || interval != s.discoveryInterval
+	if changed {
+		s.discovered = nil
+	}
+	s.discoverer, s.discoveryInterval, s.static = d, interval, static
+	s.mu.Unlock()
+	if reset {
+		select {
+		case s.discoveryReset <- struct{}{}:
+		default:
+		}
+	}
+	if changed && d != nil && lookup {
+		ctx, cancel := context.WithTimeout(context.Background(), discoveryTimeout)
+		defer cancel()
+		s.Discover(ctx)
+	}
+	return s.reconcileDiscovered()
+}
+
+// Discover looks the pool's backends up once and reconciles the pool with
+// them. A failed lookup keeps the backends found before, but a successful
+// one finding nothing, such as Consul reporting no passing instance,
+// removes them.
+func (s *ServerPool) Discover(ctx context.Context) {
+	s.mu.RLock()
+	d := s.discoverer
+	s.mu.RUnlock()
+	if d == nil {
+		return
+	}
+	found, err := d.Discover(ctx)
+	if err != nil {
+		slog.Warn("service discovery failed, keeping current backends", "pool", s.name, "error", err)
+		return
+	}
+	if len(found) == 0 {
+		slog.Warn("service discovery found no backends", "pool", s.name)
+	}
+	s.mu.Lock()
+	if s.discoverer != d {
+		// The source changed while the lookup was running.
+		s.mu.Unlock()
+		return
+	}
+	s.discovered = found
+	s.mu.Unlock()
+	if err := s.reconcileDiscovered(); err != nil {
+		slog.Warn("service discovery returned an invalid backend", "pool", s.name, "error", err)
+	}
+}
+
+// reconcileDiscovered makes the pool's backends the static ones plus those
+// discovered last. A static backend wins over a discovered one with the
+// same URL.
+func (s *ServerPool) reconcileDiscovered() error {
+	s.reconcileMu.Lock()
+	defer s.reconcileMu.Unlock()
+	s.mu.RLock()
+	static, discovered := s.static, s.discovered
+	s.mu.RUnlock()
+	configs := append([]BackendConfig(nil), static...)
+	seen := make(map[string]bool, len(static))
+	for _, bc := range static {
+		if u, err := bc.parseURL(); err == nil {
+			seen[backendKey(u)] = true
+		}
+	}
+	for _, bc := range discovered {
+		u, err := bc.parseURL()
+		if err != nil {
+			return err
+		}
+		if !seen[backendKey(u)] {
+			seen[backendKey(u)] = true
+			configs = append(configs, bc)
+		}
+	}
+	return reconcileBackends(s, configs)
+}
+
+// StartDiscovery refreshes the pool's discovered backends in the background
+// until ctx is cancelled or StopDiscovery is called. It idles while the pool
+// has no discoverer.
+func (s *ServerPool) StartDiscovery(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	s.mu.Lock()
+	s.stopDiscovery, s.discoveryDone = cancel, done
+	s.mu.Unlock()
+	go func() {
+		defer close(done)
+		s.discoveryLoop(ctx)
+	}()
+}
+
+// StopDiscovery stops the discovery loop and waits for it to return.
+func (s *ServerPool) StopDiscovery() {
+	s.mu.Lock()
+	cancel, done := s.stopDiscovery, s.discoveryDone
+	s.stopDiscovery, s.discoveryDone = nil, nil
+	s.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// discoveryTick returns the time between lookups.
+func (s *ServerPool) discoveryTick() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.discoveryInterval <= 0 {
+		return defaultDiscoveryInterval
+	}
+	return s.discoveryInterval
+}
+
+// discoveryLoop looks the pool's backends up every discovery interval until
+// ctx is cancelled. A changed interval takes effect from the next tick.
+func (s *ServerPool) discoveryLoop(ctx context.Context) {
+	t := time.NewTicker(s.discoveryTick())
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.discoveryReset:
+			t.Reset(s.discoveryTick())
+		case <-t.C:
+			lookupCtx, cancel := context.WithTimeout(ctx, discoveryTimeout)
+			s.Discover(lookupCtx)
+			cancel()
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package loadbalancer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// fixedDiscovery finds the same backends on every lookup.
+type fixedDiscovery struct {
+	backends []BackendConfig
+}
+
+func (d *fixedDiscovery) Discover(ctx context.Context) ([]BackendConfig, error) {
+	return d.backends, nil
+}
+
+func TestDiscoveryKeepsAdminAddedBackends(t *testing.T) {
+	pool := NewServerPool()
+	d := &fixedDiscovery{backends: []BackendConfig{{URL: "http://10.0.0.1:80"}}}
+	if err := pool.SetDiscovery(d, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	addBackend(pool, w, httptest.NewRequest("POST", "/_lb/backends", strings.NewReader(`{"url":"http://10.0.0.2:80"}`)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("adding a backend: status = %d, want 201", w.Code)
+	}
+
+	pool.Discover(context.Background())
+	if len(pool.Backends()) != 2 {
+		t.Fatalf("after a discovery round the pool has %d backends, want the discovered and the admin-added one", len(pool.Backends()))
+	}
+
+	// Once discovery finds the backend it owns it, and drops it when it is
+	// gone again.
+	added, _ := parseBackendURL("http://10.0.0.2:80")
+	d.backends = append(d.backends, BackendConfig{URL: added.String()})
+	pool.Discover(context.Background())
+	d.backends = d.backends[:1]
+	pool.Discover(context.Background())
+	if pool.GetBackend(added) != nil {
+		t.Fatal("backend taken over by discovery was not removed with it")
+	}
+}
+
+func TestWithoutDiscoverySkipsLookup(t *testing.T) {
+	var lookups atomic.Int64
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups.Add(1)
+		w.Write([]byte("[]"))
+	}))
+	defer registry.Close()
+
+	cfg := DefaultConfig()
+	cfg.Backends = nil
+	cfg.Discovery = &DiscoveryConfig{Consul: &ConsulConfig{Address: registry.URL, Service: "api"}}
+	lb, err := New(cfg, WithoutDiscovery())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb.Stop()
+	if n := lookups.Load(); n != 0 {
+		t.Fatalf("registry was queried %d times", n)
+	}
+
+	lb, err = New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb.Stop()
+	if lookups.Load() == 0 {
+		t.Fatal("registry was not queried without WithoutDiscovery")
+	}
+}
+
+func TestConsulEmptyAnswerRemovesBackends(t *testing.T) {
+	var answer atomic.Value
+	answer.Store(`[{"Service":{"Address":"10.0.0.1","Port":80}}]`)
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := answer.Load().(string)
+		if body == "" {
+			http.Error(w, "agent unavailable", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer registry.Close()
+
+	pool := NewServerPool()
+	if err := pool.SetDiscovery(ConsulDiscovery{Address: registry.URL, Service: "api"}, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(pool.Backends()) != 1 {
+		t.Fatalf("pool has %d backends, want the one Consul reports", len(pool.Backends()))
+	}
+
+	// A failed lookup says nothing about the instances, so they stay.
+	answer.Store("")
+	pool.Discover(context.Background())
+	if len(pool.Backends()) != 1 {
+		t.Fatalf("after a failed lookup the pool has %d backends, want 1", len(pool.Backends()))
+	}
+
+	// No passing instance is an answer, and the pool follows it.
+	answer.Store("[]")
+	pool.Discover(context.Background())
+	if n := len(pool.Backends()); n != 0 {
+		t.Fatalf("after Consul reported no passing instance the pool has %d backends, want none", n)
+	}
+}
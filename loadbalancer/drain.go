@@ -0,0 +1,67 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"time"
+)
+
+// drainPollInterval is how often DrainAndRemove checks a draining backend's
+// in-flight requests.
+const drainPollInterval = 100 * time.Millisecond
+
+var (
+	// ErrBackendNotFound is returned by DrainAndRemove for a backend that
+	// is not in the pool, or was removed by someone else while draining.
+	ErrBackendNotFound = errors.New("backend not found")
+	// ErrDrainCancelled is returned by DrainAndRemove when the backend is
+	// put back in rotation before its drain completes.
+	ErrDrainCancelled = errors.New("drain cancelled")
+)
+
+// DrainAndRemove drains the backend at u, waits for its in-flight requests
+// to finish and removes it from the pool. If they have not finished within
+// timeout the backend is removed anyway and drained is false.
+//
+// The drain is abandoned, leaving the backend in the pool, when ctx is done
+// (the backend is put back in rotation) or when someone else undrains the
+// backend in the meantime (ErrDrainCancelled).
+func (s *ServerPool) DrainAndRemove(ctx context.Context, u *url.URL, timeout time.Duration) (drained bool, err error) {
+	b := s.GetBackend(u)
+	if b == nil {
+		return false, ErrBackendNotFound
+	}
+	b.SetDraining(true)
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	tick := time.NewTicker(drainPollInterval)
+	defer tick.Stop()
+	for b.ActiveConns() > 0 {
+		select {
+		case <-ctx.Done():
+			b.SetDraining(false)
+			return false, ctx.Err()
+		case <-deadline.C:
+			return false, s.removeDrained(b)
+		case <-tick.C:
+			if !b.IsDraining() {
+				return false, ErrDrainCancelled
+			}
+		}
+	}
+	return true, s.removeDrained(b)
+}
+
+// removeDrained removes b once its drain is over, unless it was undrained or
+// removed in the meantime.
+func (s *ServerPool) removeDrained(b *Backend) error {
+	if !b.IsDraining() {
+		return ErrDrainCancelled
+	}
+	if s.GetBackend(b.url) != b || !s.RemoveBackend(b.url) {
+		return ErrBackendNotFound
+	}
+	return nil
+}
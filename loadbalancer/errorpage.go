@@ -0,0 +1,52 @@
+package loadbalancer
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrorPage customizes the error responses the load balancer generates
+// itself, such as 502 and 503. Body may contain {status}, {status_text} and
+// {message}, which are replaced by the status code, its standard text and a
+// short description of what went wrong. An empty Body keeps the plain-text
+// default.
+type ErrorPage struct {
+	ContentType string `yaml:"content_type"`
+	Body        string `yaml:"body"`
+}
+
+// render returns the content type and body of the page for code. message
+// is the plain-text body used when no custom body is configured.
+func (p ErrorPage) render(code int, message string) (contentType, body string) {
+	if p.Body == "" {
+		return "text/plain; charset=utf-8", message + "\n"
+	}
+	contentType = p.ContentType
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+	body = strings.NewReplacer(
+		"{status}", strconv.Itoa(code),
+		"{status_text}", http.StatusText(code),
+		"{message}", message,
+	).Replace(p.Body)
+	return contentType, body
+}
+
+// write replies to the request with code. message is the plain-text body
+// used when no custom body is configured.
+func (p ErrorPage) write(w http.ResponseWriter, code int, message string) {
+	if p.Body == "" {
+		http.Error(w, message, code)
+		return
+	}
+	contentType, body := p.render(code, message)
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", contentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	_, _ = io.WriteString(w, body)
+}
@@ -0,0 +1,115 @@
+package loadbalancer
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// eventKeepAlive is how often an idle event stream gets a comment line, so
+// that proxies in between do not time it out.
+const eventKeepAlive = 15 * time.Second
+
+// backendEvent reports a backend's state after it went up or down or
+// started or stopped draining.
+type backendEvent struct {
+	Time     time.Time `json:"time"`
+	Pool     string    `json:"pool"`
+	Backend  string    `json:"backend"`
+	Alive    bool      `json:"alive"`
+	Draining bool      `json:"draining"`
+}
+
+// eventHub fans backend events out to the subscribers of /_lb/events. A
+// subscriber that falls behind misses events rather than holding up the
+// backend changing state.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan backendEvent]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[chan backendEvent]struct{})}
+}
+
+func (h *eventHub) subscribe() chan backendEvent {
+	ch := make(chan backendEvent, 64)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan backendEvent) {
+	h.mu.Lock()
+	delete(h.subs, ch)
+	h.mu.Unlock()
+}
+
+func (h *eventHub) publish(e backendEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// publishState sends b's current state to the pool's event subscribers.
+func (s *ServerPool) publishState(b *Backend) {
+	if s.events == nil {
+		return
+	}
+	b.mux.RLock()
+	alive, draining := b.isAlive, b.draining
+	b.mux.RUnlock()
+	s.events.publish(backendEvent{
+		Time:     time.Now(),
+		Pool:     s.name,
+		Backend:  b.url.String(),
+		Alive:    alive,
+		Draining: draining,
+	})
+}
+
+// serveEvents streams backend events to the client as Server-Sent Events
+// until it disconnects.
+func serveEvents(hub *eventHub, w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		slog.Error("admin: streaming events", "error", err)
+		return
+	}
+
+	ch := hub.subscribe()
+	defer hub.unsubscribe(ch)
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			_, err = w.Write([]byte(": keepalive\n\n"))
+		case e := <-ch:
+			data, _ := json.Marshal(e)
+			_, err = w.Write([]byte("event: backend\ndata: " + string(data) + "\n\n"))
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// probeGRPC calls grpc.health.v1.Health/Check on the backend. https
+// backends are reached over TLS, with the certificates upstream_tls
+// configures for them, anything else in plain text.
+func (hc HealthCheck) probeGRPC(ctx context.Context, b *Backend) error {
+	u := b.url
+	target := u.Host
+	if u.Scheme == schemeUnix {
+		target = "unix://" + u.Path
+	}
+	creds := insecure.NewCredentials()
+	if u.Scheme == "https" {
+		tlsCfg, err := b.upstreamTLSConfig()
+		if err != nil {
+			return err
+		}
+		creds = credentials.NewTLS(tlsCfg)
+	}
+	// The client connects lazily, so the deadline bounds the connection
+	// attempt along with the call.
+	conn, err := grpc.NewClient(target, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, hc.Timeout)
+	defer cancel()
+
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: hc.Service})
+	if err != nil {
+		return err
+	}
+	if status := resp.GetStatus(); status != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("service %q is %s", hc.Service, status)
+	}
+	return nil
+}
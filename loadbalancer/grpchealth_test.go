@@ -0,0 +1,44 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestGRPCProbeUsesUpstreamTLS(t *testing.T) {
+	// The test server only lends its certificate, issued for 127.0.0.1 by
+	// a CA nobody trusts by default.
+	certSrv := httptest.NewTLSServer(http.NotFoundHandler())
+	certSrv.Close()
+	ca := writeCA(t, certSrv)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{Certificates: certSrv.TLS.Certificates})))
+	healthpb.RegisterHealthServer(srv, health.NewServer())
+	go srv.Serve(ln)
+	defer srv.Stop()
+
+	for _, trusted := range []bool{false, true} {
+		lb, _ := newTestLB(t, []string{"https://" + ln.Addr().String()}, func(c *Config) {
+			c.HealthCheck.Mode = HealthModeGRPC
+			if trusted {
+				c.UpstreamTLS.CAFile = ca
+			}
+		})
+		if alive := lb.CheckHealth(context.Background()); (alive == 1) != trusted {
+			t.Errorf("with the CA trusted %v, %d backends alive", trusted, alive)
+		}
+	}
+}
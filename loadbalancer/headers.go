@@ -0,0 +1,98 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Values of BackendConfig.HostHeader.
+const (
+	HostHeaderPreserve = "preserve"
+	HostHeaderBackend  = "backend"
+)
+
+// setForwardedHeaders tells the backend about the original client. The
+// reverse proxy itself appends the client address to X-Forwarded-For after
+// the Director runs, so that header is not touched here.
+func setForwardedHeaders(out *http.Request) {
+	out.Header.Set("X-Real-IP", clientIP(out, false))
+	out.Header.Set("X-Forwarded-Host", out.Host)
+	if out.TLS != nil {
+		out.Header.Set("X-Forwarded-Proto", "https")
+	} else {
+		out.Header.Set("X-Forwarded-Proto", "http")
+	}
+}
+
+// hopHeaders are the hop-by-hop headers of RFC 7230, section 6.1, plus the
+// non-standard ones still seen in the wild. They describe a single
+// connection and must not be forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders deletes the hop-by-hop headers from h, including any
+// named in its Connection header.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// responseTracker records whether a response has been started, after which
+// a failed request can no longer be retried.
+type responseTracker struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (w *responseTracker) WriteHeader(code int) {
+	// Informational responses leave the final response still to come.
+	if code >= http.StatusOK || code == http.StatusSwitchingProtocols {
+		w.started = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseTracker) Write(b []byte) (int, error) {
+	w.started = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *responseTracker) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// isUpgrade reports whether r asks to switch protocols, as a WebSocket
+// handshake does. The reverse proxy keeps the Upgrade and Connection headers
+// of such requests and, once the backend agrees, splices the client and
+// backend connections together, so every frame after the handshake goes to
+// the backend that accepted it.
+func isUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
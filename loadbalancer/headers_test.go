@@ -0,0 +1,229 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// websocketAccept computes the Sec-WebSocket-Accept value for key, see RFC
+// 6455 section 4.2.2.
+func websocketAccept(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+"258EAFA5-E914-47DA-95CA-C5AB0DC85B11")
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// writeFrame writes payload, which must be shorter than 126 bytes, as a
+// single text frame. Client frames are masked.
+func writeFrame(w io.Writer, payload []byte, masked bool) error {
+	frame := []byte{0x81, byte(len(payload))}
+	if !masked {
+		frame = append(frame, payload...)
+	} else {
+		key := [4]byte{1, 2, 3, 4}
+		frame[1] |= 0x80
+		frame = append(frame, key[:]...)
+		for i, c := range payload {
+			frame = append(frame, c^key[i%4])
+		}
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+// readFrame reads a single frame written by writeFrame and returns its
+// unmasked payload.
+func readFrame(r io.Reader) ([]byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	var key [4]byte
+	if head[1]&0x80 != 0 {
+		if _, err := io.ReadFull(r, key[:]); err != nil {
+			return nil, err
+		}
+	}
+	payload := make([]byte, head[1]&0x7f)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	for i := range payload {
+		payload[i] ^= key[i%4]
+	}
+	return payload, nil
+}
+
+// echoWebSocket accepts WebSocket handshakes and echoes every frame back.
+func echoWebSocket(t *testing.T) *httptest.Server {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isUpgrade(r) || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			http.Error(w, "upgrade headers missing", http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\n" +
+			"Connection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + websocketAccept(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n")
+		rw.Flush()
+		for {
+			payload, err := readFrame(rw)
+			if err != nil {
+				return
+			}
+			if err := writeFrame(conn, payload, false); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+func TestWebSocketThroughLoadBalancer(t *testing.T) {
+	backend := echoWebSocket(t)
+	const timeout = 50 * time.Millisecond
+	_, srv := newTestLB(t, []string{backend.URL}, func(c *Config) {
+		c.RequestTimeout = timeout
+	})
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	const key = "dGhlIHNhbXBsZSBub25jZQ=="
+	io.WriteString(conn, "GET /chat HTTP/1.1\r\n"+
+		"Host: example.com\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: "+key+"\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake status = %d, want 101", resp.StatusCode)
+	}
+	if got, want := resp.Header.Get("Sec-WebSocket-Accept"), websocketAccept(key); got != want {
+		t.Fatalf("Sec-WebSocket-Accept = %q, want %q", got, want)
+	}
+
+	// The upgraded connection outlives the request timeout.
+	time.Sleep(4 * timeout)
+	for _, msg := range []string{"hello", "still there"} {
+		if err := writeFrame(conn, []byte(msg), true); err != nil {
+			t.Fatal(err)
+		}
+		payload, err := readFrame(br)
+		if err != nil {
+			t.Fatalf("reading echo of %q: %v", msg, err)
+		}
+		if string(payload) != msg {
+			t.Fatalf("echo = %q, want %q", payload, msg)
+		}
+	}
+}
+
+func TestHopByHopHeadersNotForwarded(t *testing.T) {
+	seen := make(chan http.Header, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.Header.Clone()
+		w.Header().Set("Connection", "X-Backend-Hop")
+		w.Header().Set("X-Backend-Hop", "1")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("Proxy-Authenticate", "Basic")
+		w.Header().Set("X-Backend-End", "1")
+	}))
+	defer backend.Close()
+	_, srv := newTestLB(t, []string{backend.URL}, nil)
+
+	req, err := http.NewRequest("GET", srv.URL+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "keep-alive, X-Client-Hop")
+	req.Header.Set("X-Client-Hop", "1")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("Proxy-Connection", "keep-alive")
+	req.Header.Set("Proxy-Authorization", "Basic YTph")
+	req.Header.Set("Te", "deflate")
+	req.Header.Set("Upgrade", "h2c")
+	req.Header.Set("X-Client-End", "1")
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	got := <-seen
+	for _, name := range []string{"Connection", "X-Client-Hop", "Keep-Alive", "Proxy-Connection", "Proxy-Authorization", "Te", "Upgrade"} {
+		if v, ok := got[name]; ok {
+			t.Errorf("upstream got hop-by-hop header %s: %q", name, v)
+		}
+	}
+	if got.Get("X-Client-End") == "" {
+		t.Error("end-to-end request header X-Client-End was dropped")
+	}
+
+	for _, name := range []string{"X-Backend-Hop", "Keep-Alive", "Proxy-Authenticate"} {
+		if v, ok := resp.Header[name]; ok {
+			t.Errorf("client got hop-by-hop header %s: %q", name, v)
+		}
+	}
+	if resp.Header.Get("X-Backend-End") == "" {
+		t.Error("end-to-end response header X-Backend-End was dropped")
+	}
+}
+
+func TestForwardedHeadersDisabled(t *testing.T) {
+	seen := make(chan http.Header, 2)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	for _, enabled := range []bool{true, false} {
+		_, srv := newTestLB(t, []string{backend.URL}, func(c *Config) {
+			c.ForwardedHeaders = enabled
+		})
+		req, err := http.NewRequest("GET", srv.URL+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Forwarded-For", "192.0.2.1")
+		resp, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		got := <-seen
+		for _, name := range []string{"X-Forwarded-For", "X-Real-Ip", "X-Forwarded-Host", "X-Forwarded-Proto"} {
+			if _, ok := got[name]; ok != enabled {
+				t.Errorf("forwarded_headers %v: %s sent = %v, values %q", enabled, name, ok, got.Values(name))
+			}
+		}
+		if enabled && got.Get("X-Forwarded-For") != "192.0.2.1, 127.0.0.1" {
+			t.Errorf("X-Forwarded-For = %q, want the client address appended", got.Get("X-Forwarded-For"))
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	HealthModeTCP  = "tcp"
+	HealthModeHTTP = "http"
+	HealthModeGRPC = "grpc"
+	// HealthModeNone does not probe backends, leaving them up unless
+	// passive health checks mark them down. It suits pools whose
+	// discovery source already returns only healthy backends.
+	HealthModeNone = "none"
+)
+
+// HealthCheck describes how backends are probed. In TCP mode a backend is up
+// when it accepts a connection; in HTTP mode it must answer a GET on Path
+// with one of ExpectedStatus; in gRPC mode it must report SERVING for
+// Service through the gRPC health checking protocol. In none mode backends
+// are not probed.
+type HealthCheck struct {
+	Mode           string        `yaml:"mode"`
+	Path           string        `yaml:"path"`
+	ExpectedStatus []int         `yaml:"expected_status"`
+	Timeout        time.Duration `yaml:"timeout"`
+	// Method is the HTTP probe's method: GET, the default, HEAD to skip
+	// the body, or OPTIONS.
+	Method string `yaml:"method"`
+	// Host and Headers are sent with HTTP probes, for endpoints behind
+	// virtual hosts or requiring a token. Empty Host uses the backend's
+	// address.
+	Host    string            `yaml:"host"`
+	Headers map[string]string `yaml:"headers"`
+	// FollowRedirects follows redirects from the health endpoint and
+	// checks the final response. By default a 3xx is checked against
+	// ExpectedStatus like any other status, which marks the backend down
+	// unless it is listed there.
+	FollowRedirects bool `yaml:"follow_redirects"`
+	// Service is the gRPC service whose health is checked. Empty asks for
+	// the server as a whole.
+	Service string `yaml:"service"`
+	// Concurrency bounds how many backends are probed at the same time.
+	Concurrency int `yaml:"concurrency"`
+	// Verbose logs the result of every probe and sweep. By default only
+	// state changes are logged.
+	Verbose bool `yaml:"verbose"`
+	// UnhealthyThreshold is how many probes in a row must fail before an
+	// up backend is marked down, and HealthyThreshold how many must pass
+	// before a down backend is marked up again.
+	UnhealthyThreshold int `yaml:"unhealthy_threshold"`
+	HealthyThreshold   int `yaml:"healthy_threshold"`
+}
+
+func defaultHealthCheck() HealthCheck {
+	return HealthCheck{
+		Mode:           HealthModeTCP,
+		Path:           "/health",
+		ExpectedStatus: []int{http.StatusOK},
+		Timeout:        2 * time.Second,
+		Method:         http.MethodGet,
+		Concurrency:    16,
+
+		UnhealthyThreshold: 1,
+		HealthyThreshold:   1,
+	}
+}
+
+func (hc HealthCheck) validate() error {
+	switch hc.Mode {
+	case HealthModeTCP, HealthModeHTTP, HealthModeGRPC, HealthModeNone:
+	default:
+		return fmt.Errorf("unknown mode %q, want %q, %q, %q or %q", hc.Mode, HealthModeTCP, HealthModeHTTP, HealthModeGRPC, HealthModeNone)
+	}
+	if hc.Timeout <= 0 {
+		return fmt.Errorf("timeout must be positive, got %s", hc.Timeout)
+	}
+	switch hc.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		return fmt.Errorf("unsupported method %q, want GET, HEAD or OPTIONS", hc.Method)
+	}
+	for name := range hc.Headers {
+		if name == "" {
+			return fmt.Errorf("header names must not be empty")
+		}
+	}
+	if hc.Concurrency <= 0 {
+		return fmt.Errorf("concurrency must be positive, got %d", hc.Concurrency)
+	}
+	if hc.UnhealthyThreshold <= 0 {
+		return fmt.Errorf("unhealthy_threshold must be positive, got %d", hc.UnhealthyThreshold)
+	}
+	if hc.HealthyThreshold <= 0 {
+		return fmt.Errorf("healthy_threshold must be positive, got %d", hc.HealthyThreshold)
+	}
+	return nil
+}
+
+// PassiveHealthCheck marks a backend down once MaxFailures proxy errors occur
+// in a row, all within Window of the first one. A successful response resets
+// the streak. A MaxFailures of 0 disables passive checks.
+type PassiveHealthCheck struct {
+	MaxFailures int           `yaml:"max_failures"`
+	Window      time.Duration `yaml:"window"`
+}
+
+// recordProbe adds a probe result to the backend's streak of passed or
+// failed probes and returns whether the backend should now be alive: its
+// state only flips once the streak reaches hc's threshold.
+func (b *Backend) recordProbe(passed bool, hc HealthCheck) bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if passed {
+		b.probesPassed++
+		b.probesFailed = 0
+		return b.isAlive || b.probesPassed >= hc.HealthyThreshold
+	}
+	b.probesFailed++
+	b.probesPassed = 0
+	return b.isAlive && b.probesFailed < hc.UnhealthyThreshold
+}
+
+// recordFailure adds a failure to the backend's streak and reports whether
+// the streak has reached the passive health-check threshold.
+func (b *Backend) recordFailure(phc PassiveHealthCheck) bool {
+	if phc.MaxFailures <= 0 {
+		return false
+	}
+	now := time.Now()
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.failures == 0 || (phc.Window > 0 && now.Sub(b.firstFailure) > phc.Window) {
+		b.failures = 0
+		b.firstFailure = now
+	}
+	b.failures++
+	return b.failures >= phc.MaxFailures
+}
+
+func (b *Backend) resetFailures() {
+	b.mux.Lock()
+	b.failures = 0
+	b.mux.Unlock()
+}
+
+func (b *Backend) consecutiveFailures() (n int) {
+	b.mux.RLock()
+	n = b.failures
+	b.mux.RUnlock()
+	return
+}
+
+// admitSlowStart decides whether a backend that recently came back up takes
+// the current request. The admitted fraction grows linearly from zero to one
+// over the slow-start window after the backend turned healthy.
+func (b *Backend) admitSlowStart(window time.Duration) bool {
+	if window <= 0 {
+		return true
+	}
+	b.mux.RLock()
+	since := b.healthySince
+	b.mux.RUnlock()
+	if since.IsZero() {
+		return true
+	}
+	elapsed := time.Since(since)
+	if elapsed >= window {
+		return true
+	}
+	return rand.Float64() < float64(elapsed)/float64(window)
+}
+
+// StateHook is called with a backend's URL when the backend goes up
+// (alive is true) or down. It runs on its own goroutine, so a slow hook does
+// not hold up health checks or requests, and calls for different
+// transitions may overlap.
+type StateHook func(backend string, alive bool)
+
+// OnStateChange registers hook to be called on every backend state change
+// in the pool, whether found by active health checks, passive health checks
+// or set through the admin API.
+func (s *ServerPool) OnStateChange(hook StateHook) {
+	s.mu.Lock()
+	s.hooks = append(s.hooks, hook)
+	s.mu.Unlock()
+}
+
+func (s *ServerPool) notifyState(b *Backend, alive bool) {
+	s.mu.RLock()
+	hooks := s.hooks
+	s.mu.RUnlock()
+	for _, hook := range hooks {
+		go hook(b.url.String(), alive)
+	}
+}
+
+// probe checks a single backend and returns the reason it is considered down.
+// Cancelling ctx aborts the probe. HTTP probes go through the backend's
+// transport, so they trust and present the certificates upstream_tls
+// configures for it, and reach unix socket backends over their socket.
+func (hc HealthCheck) probe(ctx context.Context, b *Backend) error {
+	u := b.url
+	switch hc.Mode {
+	case HealthModeNone:
+		return nil
+	case HealthModeGRPC:
+		return hc.probeGRPC(ctx, b)
+	}
+	ctx, cancel := context.WithTimeout(ctx, hc.Timeout)
+	defer cancel()
+
+	if hc.Mode != HealthModeHTTP {
+		network, addr := dialAddr(u)
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return err
+		}
+		_ = conn.Close()
+		return nil
+	}
+
+	t, err := b.upstreamTransport()
+	if err != nil {
+		return err
+	}
+	client := http.Client{Transport: t}
+	target := url.URL{Scheme: u.Scheme, Host: u.Host, Path: hc.Path}
+	if u.Scheme == schemeUnix {
+		// The transport dials the socket whatever the address.
+		target.Scheme, target.Host = "http", "localhost"
+	}
+	if !hc.FollowRedirects {
+		client.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+	method := hc.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	for name, value := range hc.Headers {
+		req.Header.Set(name, value)
+	}
+	if hc.Host != "" {
+		req.Host = hc.Host
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	for _, code := range hc.ExpectedStatus {
+		if resp.StatusCode == code {
+			return nil
+		}
+	}
+	return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, target.Path)
+}
+
+// checkHealth probes every backend, running up to hc.Concurrency probes in
+// parallel so one hung backend does not hold up the rest of the sweep.
+func (s *ServerPool) checkHealth(ctx context.Context, tick time.Duration) {
+	s.sweep(ctx, s.HealthCheck(), s.dueForCheck(tick))
+}
+
+// CheckHealth probes every backend once and waits for the results. Unlike
+// the periodic sweeps it ignores the healthy and unhealthy thresholds, so
+// each backend ends up in the state its probe found. It is meant to run
+// before traffic is served, when backends are merely assumed to be up.
+// Backends whose probe is cut short by ctx keep their state.
+func (s *ServerPool) CheckHealth(ctx context.Context) {
+	hc := s.HealthCheck()
+	hc.UnhealthyThreshold, hc.HealthyThreshold = 1, 1
+	s.sweep(ctx, hc, s.Backends())
+}
+
+// sweep probes backends with hc, as overridden by each backend, running up
+// to hc.Concurrency probes in parallel. Once ctx is cancelled, probes in
+// flight are aborted and no new ones start; the backends involved keep their
+// state.
+func (s *ServerPool) sweep(ctx context.Context, hc HealthCheck, backends []*Backend) {
+	sem := make(chan struct{}, max(hc.Concurrency, 1))
+	var wg sync.WaitGroup
+	for _, b := range backends {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(b *Backend) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			start := time.Now()
+			err := b.HealthCheckOverride().apply(hc).probe(ctx, b)
+			if ctx.Err() != nil {
+				return
+			}
+			b.recordCheck(CheckResult{At: start, Duration: time.Since(start), Err: err})
+			changed := b.setAlive(b.recordProbe(err == nil, hc))
+			switch {
+			case changed && err != nil:
+				slog.Warn("backend state changed", "pool", s.name, "backend", b.url.String(), "from", "up", "to", "down", "error", err)
+			case changed:
+				slog.Info("backend state changed", "pool", s.name, "backend", b.url.String(), "from", "down", "to", "up")
+			case hc.Verbose && err != nil:
+				slog.Warn("health check", "backend", b.url.String(), "status", "down", "alive", b.IsAlive(), "error", err)
+			case hc.Verbose:
+				slog.Info("health check", "backend", b.url.String(), "status", "up", "alive", b.IsAlive())
+			}
+		}(b)
+	}
+	wg.Wait()
+}
+
+// StartHealthChecks runs the pool's health check loop in the background
+// until ctx is cancelled or StopHealthChecks is called.
+func (s *ServerPool) StartHealthChecks(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	s.mu.Lock()
+	s.stopHealth, s.healthDone = cancel, done
+	s.mu.Unlock()
+	go func() {
+		defer close(done)
+		s.healthCheck(ctx)
+	}()
+}
+
+// StopHealthChecks stops the health check loop and waits for a sweep in
+// progress to finish.
+func (s *ServerPool) StopHealthChecks() {
+	s.mu.Lock()
+	cancel, done := s.stopHealth, s.healthDone
+	s.stopHealth, s.healthDone = nil, nil
+	s.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// healthCheck sweeps the pool every health interval, or more often for
+// backends with a shorter interval of their own, until ctx is cancelled. A
+// changed interval takes effect from the next tick.
+func (s *ServerPool) healthCheck(ctx context.Context) {
+	tick := s.healthTick()
+	t := time.NewTicker(tick)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.healthReset:
+			tick = s.healthTick()
+			t.Reset(tick)
+		case <-t.C:
+			verbose := s.HealthCheck().Verbose
+			if verbose {
+				slog.Info("starting health check", "pool", s.name)
+			}
+			s.checkHealth(ctx, tick)
+			if verbose {
+				slog.Info("health check completed", "pool", s.name)
+			}
+		}
+	}
+}
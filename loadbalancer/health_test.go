@@ -0,0 +1,42 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeCA saves the certificate of srv, a TLS test server, as a PEM bundle
+// and returns its path.
+func writeCA(t *testing.T, srv *httptest.Server) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestHTTPProbeUsesUpstreamTLS(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	ca := writeCA(t, backend)
+
+	for _, trusted := range []bool{false, true} {
+		lb, _ := newTestLB(t, []string{backend.URL}, func(c *Config) {
+			c.HealthCheck.Mode = HealthModeHTTP
+			if trusted {
+				c.UpstreamTLS.CAFile = ca
+			}
+		})
+		// A backend behind a private CA only passes with the CA trusted.
+		if alive := lb.CheckHealth(context.Background()); (alive == 1) != trusted {
+			t.Errorf("with the CA trusted %v, %d backends alive", trusted, alive)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"time"
+)
+
+// HealthCheckOverride replaces parts of the pool's health check for a
+// single backend. Zero fields keep the pool's setting. Interval makes the
+// backend probed at its own pace rather than on every sweep.
+type HealthCheckOverride struct {
+	Mode           string        `yaml:"mode"`
+	Path           string        `yaml:"path"`
+	ExpectedStatus []int         `yaml:"expected_status"`
+	Timeout        time.Duration `yaml:"timeout"`
+	Service        string        `yaml:"service"`
+	Interval       time.Duration `yaml:"interval"`
+	Method         string        `yaml:"method"`
+	Host           string        `yaml:"host"`
+	// Headers replace the pool's probe headers as a whole.
+	Headers         map[string]string `yaml:"headers"`
+	FollowRedirects *bool             `yaml:"follow_redirects"`
+}
+
+// apply returns hc with o's fields laid over it. A nil o returns hc.
+func (o *HealthCheckOverride) apply(hc HealthCheck) HealthCheck {
+	if o == nil {
+		return hc
+	}
+	if o.Mode != "" {
+		hc.Mode = o.Mode
+	}
+	if o.Path != "" {
+		hc.Path = o.Path
+	}
+	if len(o.ExpectedStatus) > 0 {
+		hc.ExpectedStatus = o.ExpectedStatus
+	}
+	if o.Timeout > 0 {
+		hc.Timeout = o.Timeout
+	}
+	if o.Service != "" {
+		hc.Service = o.Service
+	}
+	if o.Method != "" {
+		hc.Method = o.Method
+	}
+	if o.Host != "" {
+		hc.Host = o.Host
+	}
+	if o.Headers != nil {
+		hc.Headers = o.Headers
+	}
+	if o.FollowRedirects != nil {
+		hc.FollowRedirects = *o.FollowRedirects
+	}
+	return hc
+}
+
+func (o *HealthCheckOverride) validate(hc HealthCheck) error {
+	if o == nil {
+		return nil
+	}
+	if o.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative, got %s", o.Timeout)
+	}
+	if o.Interval < 0 {
+		return fmt.Errorf("interval must not be negative, got %s", o.Interval)
+	}
+	return o.apply(hc).validate()
+}
+
+// SetHealthCheck overrides the pool's health check settings for this
+// backend, or goes back to them when o is nil. o is copied.
+func (b *Backend) SetHealthCheck(o *HealthCheckOverride) {
+	var copied *HealthCheckOverride
+	if o != nil {
+		c := *o
+		copied = &c
+	}
+	b.mux.Lock()
+	changed := b.healthInterval() != copied.interval()
+	b.healthOverride = copied
+	b.mux.Unlock()
+	if changed && b.pool != nil {
+		b.pool.resetHealthTicker()
+	}
+}
+
+// HealthCheckOverride returns a copy of the backend's health check
+// override, nil if it has none.
+func (b *Backend) HealthCheckOverride() *HealthCheckOverride {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	if b.healthOverride == nil {
+		return nil
+	}
+	o := *b.healthOverride
+	return &o
+}
+
+func (o *HealthCheckOverride) interval() time.Duration {
+	if o == nil {
+		return 0
+	}
+	return o.Interval
+}
+
+// healthInterval is the backend's own probe interval, zero when it follows
+// the pool's sweeps. b.mux must be held.
+func (b *Backend) healthInterval() time.Duration {
+	return b.healthOverride.interval()
+}
+
+// healthTick is how often the pool's health check loop wakes up: its own
+// interval, or a shorter backend interval.
+func (s *ServerPool) healthTick() time.Duration {
+	tick := s.HealthInterval()
+	for _, b := range s.Backends() {
+		b.mux.RLock()
+		d := b.healthInterval()
+		b.mux.RUnlock()
+		if d > 0 && d < tick {
+			tick = d
+		}
+	}
+	return tick
+}
+
+// dueForCheck returns the backends whose interval has elapsed since their
+// last probe, allowing half a tick of slack so they are not pushed back a
+// whole tick by scheduling jitter.
+func (s *ServerPool) dueForCheck(tick time.Duration) []*Backend {
+	poolInterval := s.HealthInterval()
+	backends := s.Backends()
+	due := make([]*Backend, 0, len(backends))
+	now := time.Now()
+	for _, b := range backends {
+		b.mux.RLock()
+		interval, last := b.healthInterval(), b.lastCheck.At
+		b.mux.RUnlock()
+		if interval == 0 {
+			interval = poolInterval
+		}
+		if last.IsZero() || now.Sub(last) >= interval-tick/2 {
+			due = append(due, b)
+		}
+	}
+	return due
+}
@@ -0,0 +1,100 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// ConcurrencyConfig caps the number of requests the load balancer proxies at
+// once, across all pools. A request arriving at the limit waits up to
+// QueueTimeout for a slot to free up, or is rejected with 503 straight away
+// when QueueTimeout is zero. A zero MaxRequests disables the limit.
+type ConcurrencyConfig struct {
+	MaxRequests  int           `yaml:"max_requests"`
+	QueueTimeout time.Duration `yaml:"queue_timeout"`
+}
+
+func (c ConcurrencyConfig) validate() error {
+	if c.MaxRequests < 0 {
+		return fmt.Errorf("max_requests must not be negative, got %d", c.MaxRequests)
+	}
+	if c.QueueTimeout < 0 {
+		return fmt.Errorf("queue_timeout must not be negative, got %s", c.QueueTimeout)
+	}
+	return nil
+}
+
+// concurrencyLimiter is a semaphore over in-flight requests. It counts
+// in-flight and queued requests even when no limit is set.
+type concurrencyLimiter struct {
+	// sem holds a token per in-flight request; it is nil without a limit.
+	sem          chan struct{}
+	queueTimeout time.Duration
+	inFlight     int64
+	queued       int64
+}
+
+func newConcurrencyLimiter(cfg ConcurrencyConfig) *concurrencyLimiter {
+	l := &concurrencyLimiter{queueTimeout: cfg.QueueTimeout}
+	if cfg.MaxRequests > 0 {
+		l.sem = make(chan struct{}, cfg.MaxRequests)
+	}
+	return l
+}
+
+// acquire takes a slot for a request, queueing for it if needed, and
+// reports whether it got one. Every successful acquire must be followed by
+// a release.
+func (l *concurrencyLimiter) acquire(ctx context.Context) bool {
+	if l.sem != nil {
+		select {
+		case l.sem <- struct{}{}:
+		default:
+			if l.queueTimeout <= 0 || !l.wait(ctx) {
+				return false
+			}
+		}
+	}
+	atomic.AddInt64(&l.inFlight, 1)
+	return true
+}
+
+func (l *concurrencyLimiter) wait(ctx context.Context) bool {
+	atomic.AddInt64(&l.queued, 1)
+	defer atomic.AddInt64(&l.queued, -1)
+	t := time.NewTimer(l.queueTimeout)
+	defer t.Stop()
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (l *concurrencyLimiter) release() {
+	atomic.AddInt64(&l.inFlight, -1)
+	if l.sem != nil {
+		<-l.sem
+	}
+}
+
+// InFlight returns the number of requests currently being proxied.
+func (l *concurrencyLimiter) InFlight() int64 {
+	return atomic.LoadInt64(&l.inFlight)
+}
+
+// Queued returns the number of requests waiting for a slot.
+func (l *concurrencyLimiter) Queued() int64 {
+	return atomic.LoadInt64(&l.queued)
+}
+
+// Limit returns the maximum number of concurrent requests, or zero when
+// there is no limit.
+func (l *concurrencyLimiter) Limit() int {
+	return cap(l.sem)
+}
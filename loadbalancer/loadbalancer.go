@@ -0,0 +1,373 @@
+// Package loadbalancer implements an HTTP and TCP load balancer over pools of
+// backends, with active and passive health checking, several balancing
+// algorithms, retries and an admin API.
+//
+// A LoadBalancer is built from a Config with New and is an http.Handler, so
+// it can be served on its own or mounted into an existing server:
+//
+//	lb, err := loadbalancer.New(cfg)
+//	if err != nil {
+//		return err
+//	}
+//	lb.Start(ctx)
+//	defer lb.Stop()
+//	mux.Handle("/app/", http.StripPrefix("/app", lb))
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// LoadBalancer routes requests to its pools and owns their health check
+// loops and metrics.
+type LoadBalancer struct {
+	router  Router
+	limiter *concurrencyLimiter
+	metrics *metrics
+	events  *eventHub
+	handler http.Handler
+	rate    *rateLimiter
+	// tracerProvider exports spans when tracing is enabled.
+	tracerProvider *sdktrace.TracerProvider
+	// errorPage shapes the errors generated before a pool is involved.
+	errorPage atomic.Pointer[ErrorPage]
+	// maxBodySize is the request body limit of requests whose route sets
+	// none.
+	maxBodySize atomic.Int64
+	bodyBuffer  atomic.Pointer[BodyBufferConfig]
+	maintenance maintenance
+	// adminAuth guards the admin API; nil leaves it open.
+	adminAuth atomic.Pointer[adminAuth]
+	// debugRouting honors backend override headers; nil ignores them.
+	debugRouting atomic.Pointer[debugRouting]
+	// noDiscovery skips the discovery lookups when pools are configured;
+	// see WithoutDiscovery.
+	noDiscovery bool
+
+	mu sync.Mutex
+	// ctx is set by Start. Pools added by Reload after that get their
+	// health check loop started under it.
+	ctx context.Context
+	// hooks are registered on every pool, including ones added by Reload.
+	hooks []StateHook
+}
+
+// New builds a load balancer from cfg, which must be valid. Health checks
+// do not run until Start is called.
+func New(cfg Config, opts ...NewOption) (*LoadBalancer, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	var o newOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	lb := &LoadBalancer{
+		limiter:     newConcurrencyLimiter(cfg.Concurrency),
+		metrics:     newMetrics(cfg.Metrics),
+		events:      newEventHub(),
+		noDiscovery: o.noDiscovery,
+	}
+	if err := lb.apply(cfg); err != nil {
+		return nil, err
+	}
+	lb.maintenance.on.Store(cfg.Maintenance.Enabled)
+	lb.metrics.register(&lb.router, lb.limiter)
+
+	tracer, tp, err := newTracerProvider(cfg.Tracing)
+	if err != nil {
+		return nil, fmt.Errorf("tracing: %w", err)
+	}
+	lb.tracerProvider = tp
+
+	// Built-in middleware are only available while enabled.
+	builtin := make(map[string]Middleware)
+	if cfg.RateLimit.Enabled() {
+		lb.rate = newRateLimiter(cfg.RateLimit)
+		builtin[MiddlewareRateLimit] = func(h http.Handler) http.Handler {
+			return rateLimit(h, lb.rate, lb.metrics, lb.writeError)
+		}
+	}
+	if cfg.Compression.Enabled {
+		builtin[MiddlewareCompression] = func(h http.Handler) http.Handler { return compress(h, cfg.Compression) }
+	}
+	if cfg.AccessLog.Enabled {
+		builtin[MiddlewareAccessLog] = func(h http.Handler) http.Handler { return accessLog(h, cfg.AccessLog.Format) }
+	}
+	if cfg.Tracing.Enabled {
+		builtin[MiddlewareTracing] = func(h http.Handler) http.Handler { return tracing(h, tracer) }
+	}
+	if cfg.RequestID.Enabled {
+		builtin[MiddlewareRequestID] = func(h http.Handler) http.Handler { return requestID(h, cfg.RequestID) }
+	}
+	var requestIDHeader string
+	if cfg.RequestID.Enabled {
+		requestIDHeader = cfg.RequestID.Header
+	}
+	builtin[MiddlewareRecover] = func(h http.Handler) http.Handler {
+		return recoverPanics(h, requestIDHeader, lb.writeError)
+	}
+	lb.handler, err = chain(http.HandlerFunc(lb.serve), cfg.middlewareOrder(), builtin, o.middleware, o.middlewareOrder)
+	if err != nil {
+		return nil, fmt.Errorf("middleware: %w", err)
+	}
+	return lb, nil
+}
+
+// Start runs the health check and discovery loops of every pool, and the
+// rate limiter's cleanup, until ctx is cancelled or Stop is called.
+func (lb *LoadBalancer) Start(ctx context.Context) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.ctx = ctx
+	for _, pool := range lb.router.Pools() {
+		pool.StartHealthChecks(ctx)
+		pool.StartDiscovery(ctx)
+	}
+	if lb.rate != nil {
+		go lb.rate.run(ctx)
+	}
+}
+
+// CheckHealth probes the backends of every pool once, in parallel, and waits
+// for the results; see ServerPool.CheckHealth. It returns how many backends
+// are alive, and warns about every pool left with none when there are
+// several.
+func (lb *LoadBalancer) CheckHealth(ctx context.Context) int {
+	pools := lb.router.Pools()
+	var wg sync.WaitGroup
+	for _, pool := range pools {
+		wg.Add(1)
+		go func(pool *ServerPool) {
+			defer wg.Done()
+			pool.CheckHealth(ctx)
+		}(pool)
+	}
+	wg.Wait()
+
+	total := 0
+	for _, pool := range pools {
+		alive := 0
+		for _, b := range pool.Backends() {
+			if b.IsAlive() {
+				alive++
+			}
+		}
+		if alive == 0 && len(pools) > 1 {
+			slog.Warn("no backend is alive", "pool", pool.name, "backends", pool.Len())
+		}
+		total += alive
+	}
+	return total
+}
+
+// Stop stops the health check loops and waits for sweeps in progress to
+// finish, then flushes spans not yet exported. It does not wait for
+// in-flight requests; shut down the server serving the load balancer for
+// that.
+func (lb *LoadBalancer) Stop() {
+	for _, pool := range lb.router.Pools() {
+		pool.StopHealthChecks()
+		pool.StopDiscovery()
+	}
+	if lb.tracerProvider != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := lb.tracerProvider.Shutdown(ctx); err != nil {
+			slog.Error("flushing traces failed", "error", err)
+		}
+	}
+}
+
+// Reload applies a new configuration to the running load balancer. Pools
+// that stay keep their backends' state. Listener, access log, rate limit,
+// concurrency, request ID, tracing, compression and middleware settings only
+// take effect in a new LoadBalancer.
+func (lb *LoadBalancer) Reload(cfg Config) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	return lb.apply(cfg)
+}
+
+// OnStateChange registers hook on every pool of the load balancer, including
+// pools added by later reloads. See ServerPool.OnStateChange.
+func (lb *LoadBalancer) OnStateChange(hook StateHook) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.hooks = append(lb.hooks, hook)
+	for _, pool := range lb.router.Pools() {
+		pool.OnStateChange(hook)
+	}
+}
+
+// Router returns the router holding the load balancer's pools.
+func (lb *LoadBalancer) Router() *Router {
+	return &lb.router
+}
+
+// AdminHandler returns the admin API, including the metrics and expvar
+// endpoints. It enforces the admin.auth settings when the admin listener is
+// configured.
+func (lb *LoadBalancer) AdminHandler() http.Handler {
+	return requireAdminAuth(newAdminHandler(&lb.router, lb.limiter, lb.metrics, &lb.maintenance, lb.events), lb.adminAuth.Load)
+}
+
+// TCPProxy returns a raw TCP proxy forwarding to one of the load
+// balancer's pools. The caller runs it with ListenAndServe.
+func (lb *LoadBalancer) TCPProxy(cfg TCPProxyConfig) *TCPProxy {
+	return newTCPProxy(cfg, &lb.router, lb.metrics)
+}
+
+func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	lb.handler.ServeHTTP(w, r)
+}
+
+// serve hands each request to the pool the router picks for it, once the
+// concurrency limiter lets it through, unless maintenance mode is on.
+func (lb *LoadBalancer) serve(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	lb.metrics.requests.Inc()
+	if lb.maintenance.on.Load() {
+		lb.maintenance.write(w)
+		return
+	}
+	if !lb.limiter.acquire(r.Context()) {
+		slog.Warn("concurrency limit reached, rejecting request", "remote_addr", r.RemoteAddr, "path", r.URL.Path, "limit", lb.limiter.Limit())
+		lb.metrics.rejected.Inc()
+		lb.writeError(w, http.StatusServiceUnavailable, "Service unavailable")
+		return
+	}
+	defer lb.limiter.release()
+	pool, route := lb.router.matchRoute(r)
+	if pool == nil {
+		lb.writeError(w, http.StatusNotFound, "404 page not found")
+		return
+	}
+	limit := lb.maxBodySize.Load()
+	if route != nil && route.MaxBodySize > 0 {
+		limit = route.MaxBodySize
+	}
+	if limit > 0 && r.Body != nil && r.Body != http.NoBody {
+		if r.ContentLength > limit {
+			lb.writeError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+	}
+	if hasBody(r) && pool.RetryPolicy().allows(r.Method) {
+		var cleanup func()
+		var err error
+		r, cleanup, err = bufferBody(r, *lb.bodyBuffer.Load())
+		defer cleanup()
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.As(err, &tooLarge):
+			lb.writeError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+			return
+		case err != nil:
+			slog.Warn("reading request body failed", "remote_addr", r.RemoteAddr, "path", r.URL.Path, "error", err)
+			lb.writeError(w, http.StatusBadRequest, "Bad request")
+			return
+		}
+	}
+	if d := lb.debugRouting.Load(); d != nil {
+		var ok bool
+		if r, ok = d.route(w, r, pool); !ok {
+			return
+		}
+	}
+	r = pool.mirrorRequest(r)
+	pool.ServeHTTP(w, r)
+	lb.metrics.observeRequest(pool, route, start)
+}
+
+// writeError replies with the top-level error page.
+func (lb *LoadBalancer) writeError(w http.ResponseWriter, code int, message string) {
+	lb.errorPage.Load().write(w, code, message)
+}
+
+// apply makes the router match cfg. Existing pools are updated in place.
+// Once the load balancer is started, new pools get their health check loop
+// started and pools that are no longer configured have theirs stopped.
+func (lb *LoadBalancer) apply(cfg Config) error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	configs := cfg.pools()
+	pools := make(map[string]*ServerPool, len(configs))
+	var added []*ServerPool
+	for name, pc := range configs {
+		pool := lb.router.Pool(name)
+		if pool == nil {
+			pool = NewServerPool(WithName(name))
+			pool.metrics = lb.metrics
+			pool.events = lb.events
+			for _, hook := range lb.hooks {
+				pool.OnStateChange(hook)
+			}
+			added = append(added, pool)
+		}
+		if err := pc.apply(pool, lb.noDiscovery); err != nil {
+			return fmt.Errorf("pool %s: %w", name, err)
+		}
+		pools[name] = pool
+	}
+	for name, pc := range configs {
+		pools[name].SetSplitter(splitterFor(pools[name], pc.Canary, pools))
+	}
+	routes := make([]Route, 0, len(cfg.Routes))
+	for _, rc := range cfg.Routes {
+		routes = append(routes, Route{Prefix: rc.Prefix, Pool: pools[rc.Pool], MaxBodySize: rc.MaxBodySize})
+	}
+	rules := make([]HeaderRule, 0, len(cfg.Rules))
+	for _, rc := range cfg.Rules {
+		rule := HeaderRule{Header: rc.Header, Value: rc.Value, Pool: pools[rc.Pool]}
+		if rc.Regex != "" {
+			rule.Regex = regexp.MustCompile(rc.Regex)
+		}
+		rules = append(rules, rule)
+	}
+	hosts := make(map[string]*ServerPool, len(cfg.Hosts))
+	for host, name := range cfg.Hosts {
+		hosts[host] = pools[name]
+	}
+
+	page := cfg.ErrorPage
+	lb.errorPage.Store(&page)
+	lb.maxBodySize.Store(cfg.MaxBodySize)
+	buffer := cfg.BodyBuffer
+	lb.bodyBuffer.Store(&buffer)
+	mc := cfg.Maintenance
+	lb.maintenance.cfg.Store(&mc)
+	lb.debugRouting.Store(newDebugRouting(cfg.DebugRouting))
+	if cfg.Admin.Listen != "" {
+		lb.adminAuth.Store(newAdminAuth(cfg.Admin.Auth))
+	} else {
+		lb.adminAuth.Store(nil)
+	}
+
+	removed := lb.router.Update(pools, rules, routes, hosts, pools[cfg.defaultPool()])
+	for _, pool := range removed {
+		pool.StopHealthChecks()
+		pool.StopDiscovery()
+		slog.Info("removed pool", "pool", pool.name)
+	}
+	if lb.ctx != nil {
+		for _, pool := range added {
+			pool.StartHealthChecks(lb.ctx)
+			pool.StartDiscovery(lb.ctx)
+		}
+	}
+	return nil
+}
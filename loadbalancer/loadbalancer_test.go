@@ -0,0 +1,44 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestLB serves a load balancer over the given backend URLs. configure,
+// if not nil, adjusts the default configuration before the load balancer is
+// built. Health checks are not started, so backends stay up unless a test
+// marks them down.
+func newTestLB(t *testing.T, backends []string, configure func(*Config)) (*LoadBalancer, *httptest.Server) {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.SlowStart = 0
+	cfg.Backends = nil
+	for _, u := range backends {
+		cfg.Backends = append(cfg.Backends, BackendConfig{URL: u})
+	}
+	if configure != nil {
+		configure(&cfg)
+	}
+	lb, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(lb.Stop)
+	srv := httptest.NewServer(lb)
+	t.Cleanup(srv.Close)
+	return lb, srv
+}
+
+// get sends a GET request for path to srv and returns the response with its
+// body closed.
+func get(t *testing.T, srv *httptest.Server, path string) *http.Response {
+	t.Helper()
+	resp, err := srv.Client().Get(srv.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
@@ -0,0 +1,33 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// MaintenanceConfig configures maintenance mode, in which every proxied
+// request gets a 503 while backends are left alone. Enabled only sets the
+// mode a new LoadBalancer starts in; afterwards it is switched through the
+// admin API.
+type MaintenanceConfig struct {
+	Enabled   bool      `yaml:"enabled"`
+	ErrorPage ErrorPage `yaml:"error_page"`
+	// RetryAfter, when set, is sent in a Retry-After header.
+	RetryAfter time.Duration `yaml:"retry_after"`
+}
+
+// maintenance is the switch and response of maintenance mode.
+type maintenance struct {
+	on  atomic.Bool
+	cfg atomic.Pointer[MaintenanceConfig]
+}
+
+func (m *maintenance) write(w http.ResponseWriter) {
+	cfg := m.cfg.Load()
+	if cfg.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(cfg.RetryAfter.Round(time.Second).Seconds())))
+	}
+	cfg.ErrorPage.write(w, http.StatusServiceUnavailable, "Service under maintenance")
+}
@@ -0,0 +1,131 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrorMask replaces backend responses whose status is in Status, such as
+// "500", "5xx" or "500-504", with the pool's error page, so the backend's
+// own body, which may hold stack traces or internal details, never reaches
+// the client. ReplaceWith is the status sent instead and defaults to 502;
+// Message is the text of the error page and defaults to the standard text
+// of that status.
+type ErrorMask struct {
+	Status      string `yaml:"status"`
+	ReplaceWith int    `yaml:"replace_with"`
+	Message     string `yaml:"message"`
+}
+
+// statusRange parses Status into the inclusive range of codes it covers.
+func (m ErrorMask) statusRange() (lo, hi int, err error) {
+	s := strings.TrimSpace(m.Status)
+	switch {
+	case len(s) == 3 && strings.HasSuffix(strings.ToLower(s), "xx"):
+		class, err := strconv.Atoi(s[:1])
+		if err != nil || class < 1 || class > 5 {
+			return 0, 0, fmt.Errorf("invalid status %q", m.Status)
+		}
+		return class * 100, class*100 + 99, nil
+	case strings.Contains(s, "-"):
+		from, to, _ := strings.Cut(s, "-")
+		lo, err1 := strconv.Atoi(strings.TrimSpace(from))
+		hi, err2 := strconv.Atoi(strings.TrimSpace(to))
+		if err1 != nil || err2 != nil || lo > hi {
+			return 0, 0, fmt.Errorf("invalid status %q", m.Status)
+		}
+		return lo, hi, validStatusRange(m.Status, lo, hi)
+	default:
+		code, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid status %q", m.Status)
+		}
+		return code, code, validStatusRange(m.Status, code, code)
+	}
+}
+
+func validStatusRange(s string, lo, hi int) error {
+	if lo < 100 || hi > 599 {
+		return fmt.Errorf("status %q is out of the range 100-599", s)
+	}
+	return nil
+}
+
+func (m ErrorMask) validate() error {
+	if _, _, err := m.statusRange(); err != nil {
+		return err
+	}
+	if m.ReplaceWith != 0 && (m.ReplaceWith < 200 || m.ReplaceWith > 599) {
+		return fmt.Errorf("replace_with must be between 200 and 599, got %d", m.ReplaceWith)
+	}
+	return nil
+}
+
+// errorMask is the parsed form of an ErrorMask.
+type errorMask struct {
+	lo, hi  int
+	code    int
+	message string
+}
+
+func compileErrorMasks(masks []ErrorMask) []errorMask {
+	compiled := make([]errorMask, 0, len(masks))
+	for _, m := range masks {
+		lo, hi, err := m.statusRange()
+		if err != nil {
+			continue
+		}
+		code := m.ReplaceWith
+		if code == 0 {
+			code = http.StatusBadGateway
+		}
+		message := m.Message
+		if message == "" {
+			message = http.StatusText(code)
+		}
+		compiled = append(compiled, errorMask{lo: lo, hi: hi, code: code, message: message})
+	}
+	return compiled
+}
+
+// SetErrorMasks makes the pool replace backend responses matching masks,
+// tried in order, with its error page.
+func (s *ServerPool) SetErrorMasks(masks []ErrorMask) {
+	compiled := compileErrorMasks(masks)
+	s.mu.Lock()
+	s.errorMasks = compiled
+	s.mu.Unlock()
+}
+
+// maskResponse swaps resp's status and body for the pool's error page when
+// a mask matches its status.
+func (s *ServerPool) maskResponse(resp *http.Response) {
+	s.mu.RLock()
+	masks, page := s.errorMasks, s.errorPage
+	s.mu.RUnlock()
+	for _, m := range masks {
+		if resp.StatusCode < m.lo || resp.StatusCode > m.hi {
+			continue
+		}
+		slog.Warn("masked backend error", "pool", s.name, "path", resp.Request.URL.Path, "status", resp.StatusCode, "replaced_with", m.code, "request_id", requestIDFrom(resp.Request))
+		contentType, body := page.render(m.code, m.message)
+		_ = resp.Body.Close()
+		h := resp.Header
+		for _, k := range []string{"Content-Encoding", "Content-Range", "Etag", "Last-Modified", "Trailer"} {
+			h.Del(k)
+		}
+		h.Set("Content-Type", contentType)
+		h.Set("Content-Length", strconv.Itoa(len(body)))
+		h.Set("X-Content-Type-Options", "nosniff")
+		resp.Trailer = nil
+		resp.StatusCode = m.code
+		resp.Status = fmt.Sprintf("%d %s", m.code, http.StatusText(m.code))
+		resp.ContentLength = int64(len(body))
+		resp.Body = io.NopCloser(strings.NewReader(body))
+		return
+	}
+}
@@ -0,0 +1,188 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics holds the collectors of one load balancer. Every LoadBalancer has
+// its own set, so several can run in one process.
+type metrics struct {
+	registry        *prometheus.Registry
+	requests        prometheus.Counter
+	backendRequests *prometheus.CounterVec
+	retries         prometheus.Counter
+	rateLimited     prometheus.Counter
+	rejected        prometheus.Counter
+	failedForwards  *prometheus.CounterVec
+	upstreamLatency *prometheus.HistogramVec
+	requestDuration *prometheus.HistogramVec
+}
+
+func newMetrics(cfg MetricsConfig) *metrics {
+	return &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "lb_requests_total",
+			Help: "Requests received by the load balancer.",
+		}),
+		backendRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "lb_backend_requests_total",
+			Help: "Requests forwarded to each backend.",
+		}, []string{"backend"}),
+		retries: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "lb_retries_total",
+			Help: "Retries against the same backend and failovers to another one.",
+		}),
+		rateLimited: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "lb_rate_limited_total",
+			Help: "Requests rejected because their client exceeded the rate limit.",
+		}),
+		rejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "lb_rejected_requests_total",
+			Help: "Requests rejected because the concurrency limit was reached.",
+		}),
+		failedForwards: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "lb_failed_forwards_total",
+			Help: "Forwarding attempts that ended in a proxy error.",
+		}, []string{"backend"}),
+		upstreamLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "lb_upstream_latency_seconds",
+			Help:    "Time taken by backends to answer each forwarding attempt, up to the response headers or the error.",
+			Buckets: cfg.LatencyBuckets,
+		}, []string{"backend"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "lb_request_duration_seconds",
+			Help:    "Time taken to serve requests, including retries, failovers and the response body, by pool and route prefix.",
+			Buckets: cfg.LatencyBuckets,
+		}, []string{"pool", "route"}),
+	}
+}
+
+// discardMetrics is used by pools that do not belong to a LoadBalancer. It
+// is never registered, so its values are not exported anywhere.
+var discardMetrics = newMetrics(defaultMetricsConfig())
+
+// MetricsConfig tunes the exported metrics. LatencyBuckets are upper bounds
+// in seconds for the upstream latency and request duration histograms.
+type MetricsConfig struct {
+	LatencyBuckets []float64 `yaml:"latency_buckets"`
+}
+
+func defaultMetricsConfig() MetricsConfig {
+	return MetricsConfig{LatencyBuckets: prometheus.DefBuckets}
+}
+
+func (m *metrics) observeLatency(b *Backend, d time.Duration) {
+	m.upstreamLatency.WithLabelValues(b.url.String()).Observe(d.Seconds())
+}
+
+// observeRequest records how long a request took from reaching the load
+// balancer until pool finished with it. The route label is the matched
+// route's prefix, empty when a header rule, host or the default pool
+// picked the pool.
+func (m *metrics) observeRequest(pool *ServerPool, route *Route, start time.Time) {
+	var prefix string
+	if route != nil {
+		prefix = route.Prefix
+	}
+	m.requestDuration.WithLabelValues(pool.Name(), prefix).Observe(time.Since(start).Seconds())
+}
+
+var backendUpDesc = prometheus.NewDesc(
+	"lb_backend_up",
+	"Whether the backend is considered alive (1) or down (0).",
+	[]string{"pool", "backend"}, nil,
+)
+
+var backendDrainingDesc = prometheus.NewDesc(
+	"lb_backend_draining",
+	"Whether the backend is draining (1) and taking no new requests.",
+	[]string{"pool", "backend"}, nil,
+)
+
+var backendInFlightDesc = prometheus.NewDesc(
+	"lb_backend_in_flight_requests",
+	"Requests the backend is currently serving.",
+	[]string{"pool", "backend"}, nil,
+)
+
+// poolCollector reports per-backend state straight from the router's pools
+// at scrape time, so removed backends and pools disappear from the output.
+type poolCollector struct {
+	router *Router
+}
+
+func (c poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- backendUpDesc
+	ch <- backendDrainingDesc
+	ch <- backendInFlightDesc
+}
+
+func (c poolCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, pool := range c.router.Pools() {
+		for _, b := range pool.Backends() {
+			collectBackend(ch, b)
+		}
+	}
+}
+
+func collectBackend(ch chan<- prometheus.Metric, b *Backend) {
+	up := 0.0
+	if b.IsAlive() {
+		up = 1
+	}
+	draining := 0.0
+	if b.IsDraining() {
+		draining = 1
+	}
+	ch <- prometheus.MustNewConstMetric(backendUpDesc, prometheus.GaugeValue, up, b.pool.name, b.url.String())
+	ch <- prometheus.MustNewConstMetric(backendDrainingDesc, prometheus.GaugeValue, draining, b.pool.name, b.url.String())
+	ch <- prometheus.MustNewConstMetric(backendInFlightDesc, prometheus.GaugeValue, float64(b.ActiveConns()), b.pool.name, b.url.String())
+}
+
+// resetBackends zeroes the per-backend request counters and latency
+// histograms. Backend state such as liveness is not metrics and is left
+// alone.
+func (m *metrics) resetBackends() {
+	m.backendRequests.Reset()
+	m.failedForwards.Reset()
+	m.upstreamLatency.Reset()
+}
+
+// register adds the collectors to the registry, along with gauges reading
+// the router's pools and the limiter's counters at scrape time and the Go
+// runtime and process metrics, such as go_goroutines and
+// process_resident_memory_bytes.
+func (m *metrics) register(router *Router, limiter *concurrencyLimiter) {
+	m.registry.MustRegister(
+		m.upstreamLatency,
+		m.requestDuration,
+		m.requests,
+		m.backendRequests,
+		m.retries,
+		m.failedForwards,
+		m.rateLimited,
+		m.rejected,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "lb_in_flight_requests",
+			Help: "Requests currently being proxied.",
+		}, func() float64 { return float64(limiter.InFlight()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "lb_queued_requests",
+			Help: "Requests waiting for the concurrency limit to free up.",
+		}, func() float64 { return float64(limiter.Queued()) }),
+		poolCollector{router: router},
+		backendInfoCollector{router: router},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,64 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// histogramCount returns the number of observations of the histogram name
+// with the given labels.
+func histogramCount(t *testing.T, m *metrics, name string, labels map[string]string) uint64 {
+	t.Helper()
+	families, err := m.registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, metric := range f.GetMetric() {
+			for _, l := range metric.GetLabel() {
+				if labels[l.GetName()] != l.GetValue() {
+					continue metrics
+				}
+			}
+			return metric.GetHistogram().GetSampleCount()
+		}
+	}
+	return 0
+}
+
+func TestLatencyObservedPerAttempt(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	lb, srv := newTestLB(t, []string{up.URL, down.URL}, func(c *Config) {
+		c.Retry.Retries = 1
+		c.Retry.BaseDelay = time.Millisecond
+		c.Routes = []RouteConfig{{Prefix: "/api", Pool: defaultPoolName}}
+	})
+	for i := 0; i < 2; i++ {
+		if resp := get(t, srv, "/api/x"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want 200", resp.StatusCode)
+		}
+	}
+
+	// One request tried the down backend and its retry before failing over;
+	// the failover marked it down, so the other request went straight to
+	// the backend that is up.
+	if got := histogramCount(t, lb.metrics, "lb_upstream_latency_seconds", map[string]string{"backend": down.URL}); got != 2 {
+		t.Errorf("down backend latency observations = %d, want 2", got)
+	}
+	if got := histogramCount(t, lb.metrics, "lb_upstream_latency_seconds", map[string]string{"backend": up.URL}); got != 2 {
+		t.Errorf("up backend latency observations = %d, want 2", got)
+	}
+	if got := histogramCount(t, lb.metrics, "lb_request_duration_seconds", map[string]string{"pool": defaultPoolName, "route": "/api"}); got != 2 {
+		t.Errorf("request duration observations = %d, want 2", got)
+	}
+}
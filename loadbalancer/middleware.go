@@ -0,0 +1,126 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Middleware wraps the handler requests go through before reaching the
+// pools.
+type Middleware func(http.Handler) http.Handler
+
+// Names of the built-in middleware, as listed in Config.Middleware.
+const (
+	MiddlewareRecover     = "recover"
+	MiddlewareRequestID   = "request_id"
+	MiddlewareTracing     = "tracing"
+	MiddlewareAccessLog   = "access_log"
+	MiddlewareCompression = "compression"
+	MiddlewareRateLimit   = "rate_limit"
+)
+
+// middlewareOrder returns c.Middleware, or the default order when it is
+// nil.
+func (c Config) middlewareOrder() []string {
+	if c.Middleware == nil {
+		return defaultMiddleware()
+	}
+	return c.Middleware
+}
+
+// defaultMiddleware is the order the built-in middleware run in, outermost
+// first, unless configured otherwise.
+func defaultMiddleware() []string {
+	return []string{MiddlewareRecover, MiddlewareRequestID, MiddlewareTracing, MiddlewareAccessLog, MiddlewareCompression, MiddlewareRateLimit}
+}
+
+// validateMiddleware checks that order names every enabled built-in
+// middleware, and no middleware twice. Whether custom names exist is only
+// known to New.
+func (c Config) validateMiddleware() error {
+	seen := make(map[string]bool, len(c.Middleware))
+	for _, name := range c.middlewareOrder() {
+		if seen[name] {
+			return fmt.Errorf("%q is listed twice", name)
+		}
+		seen[name] = true
+	}
+	enabled := map[string]bool{
+		MiddlewareRequestID:   c.RequestID.Enabled,
+		MiddlewareTracing:     c.Tracing.Enabled,
+		MiddlewareAccessLog:   c.AccessLog.Enabled,
+		MiddlewareCompression: c.Compression.Enabled,
+		MiddlewareRateLimit:   c.RateLimit.Enabled(),
+	}
+	for _, name := range defaultMiddleware() {
+		if enabled[name] && !seen[name] {
+			return fmt.Errorf("%s is enabled but not listed", name)
+		}
+	}
+	return nil
+}
+
+// NewOption customizes a LoadBalancer built by New.
+type NewOption func(*newOptions)
+
+type newOptions struct {
+	middleware      map[string]Middleware
+	middlewareOrder []string
+	noDiscovery     bool
+}
+
+// WithMiddleware adds m to the request pipeline under name. Listing name in
+// Config.Middleware places it among the built-in middleware; otherwise it
+// runs after all of them, innermost, in the order it was added. A custom
+// middleware named like a built-in one replaces it.
+func WithMiddleware(name string, m Middleware) NewOption {
+	return func(o *newOptions) {
+		if o.middleware == nil {
+			o.middleware = make(map[string]Middleware)
+		}
+		if _, ok := o.middleware[name]; !ok {
+			o.middlewareOrder = append(o.middlewareOrder, name)
+		}
+		o.middleware[name] = m
+	}
+}
+
+// chain wraps h in the middleware named by order, the first outermost,
+// followed by the custom middleware order does not name. Built-in
+// middleware missing from available are disabled and skipped.
+func chain(h http.Handler, order []string, available, custom map[string]Middleware, customOrder []string) (http.Handler, error) {
+	listed := make(map[string]bool, len(order))
+	var stack []Middleware
+	for _, name := range order {
+		listed[name] = true
+		if m, ok := custom[name]; ok {
+			stack = append(stack, m)
+			continue
+		}
+		if m, ok := available[name]; ok {
+			stack = append(stack, m)
+			continue
+		}
+		if !isBuiltinMiddleware(name) {
+			return nil, fmt.Errorf("unknown middleware %q", name)
+		}
+	}
+	for _, name := range customOrder {
+		if !listed[name] {
+			stack = append(stack, custom[name])
+		}
+	}
+	for i := len(stack) - 1; i >= 0; i-- {
+		h = stack[i](h)
+	}
+	return h, nil
+}
+
+func isBuiltinMiddleware(name string) bool {
+	for _, builtin := range defaultMiddleware() {
+		if name == builtin {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,184 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// MirrorConfig copies Percent of a pool's requests to the shadow backend at
+// URL. Mirrored requests are sent in the background after the request has
+// been read, and their responses are discarded, so the shadow can neither
+// slow down nor fail the request it copies. At most MaxInFlight mirrored
+// requests run at once; beyond that, and for bodies larger than
+// MaxBodySize, requests are not mirrored.
+type MirrorConfig struct {
+	URL         string        `yaml:"url"`
+	Percent     float64       `yaml:"percent"`
+	Timeout     time.Duration `yaml:"timeout"`
+	MaxBodySize int64         `yaml:"max_body_size"`
+	MaxInFlight int           `yaml:"max_in_flight"`
+}
+
+func (c *MirrorConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	if u, err := url.Parse(c.URL); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("invalid url %q", c.URL)
+	}
+	if c.Percent < 0 || c.Percent > 100 {
+		return fmt.Errorf("percent must be between 0 and 100, got %g", c.Percent)
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative, got %s", c.Timeout)
+	}
+	if c.MaxBodySize < 0 {
+		return fmt.Errorf("max_body_size must not be negative, got %d", c.MaxBodySize)
+	}
+	if c.MaxInFlight < 0 {
+		return fmt.Errorf("max_in_flight must not be negative, got %d", c.MaxInFlight)
+	}
+	return nil
+}
+
+// mirror sends copies of requests to a shadow backend.
+type mirror struct {
+	cfg    MirrorConfig
+	target *url.URL
+	client *http.Client
+	slots  chan struct{}
+}
+
+// withDefaults fills in the limits left at zero.
+func (c MirrorConfig) withDefaults() MirrorConfig {
+	if c.Timeout == 0 {
+		c.Timeout = 5 * time.Second
+	}
+	if c.MaxBodySize == 0 {
+		c.MaxBodySize = 1 << 20
+	}
+	if c.MaxInFlight == 0 {
+		c.MaxInFlight = 100
+	}
+	return c
+}
+
+func newMirror(c MirrorConfig) *mirror {
+	target, _ := url.Parse(c.URL)
+	return &mirror{
+		cfg:    c,
+		target: target,
+		client: &http.Client{
+			Timeout: c.Timeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		slots: make(chan struct{}, c.MaxInFlight),
+	}
+}
+
+// SetMirror makes the pool copy a share of its requests to a shadow
+// backend, or stops mirroring when c is nil.
+func (s *ServerPool) SetMirror(c *MirrorConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c == nil {
+		s.mirror = nil
+		return
+	}
+	cfg := c.withDefaults()
+	if s.mirror == nil || s.mirror.cfg != cfg {
+		s.mirror = newMirror(cfg)
+	}
+}
+
+// Mirror returns the pool's mirror settings, or nil when it does not
+// mirror requests.
+func (s *ServerPool) Mirror() *MirrorConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.mirror == nil {
+		return nil
+	}
+	c := s.mirror.cfg
+	return &c
+}
+
+// mirrorRequest sends a copy of r to the pool's shadow backend if r is
+// sampled. Reading the body to copy it leaves r able to read it again.
+func (s *ServerPool) mirrorRequest(r *http.Request) *http.Request {
+	s.mu.RLock()
+	m := s.mirror
+	s.mu.RUnlock()
+	if m == nil || r.Header.Get("Upgrade") != "" || rand.Float64()*100 >= m.cfg.Percent {
+		return r
+	}
+	var body []byte
+	switch bb := bufferedBodyFrom(r); {
+	case bb != nil:
+		if bb.size > m.cfg.MaxBodySize {
+			return r
+		}
+		data, err := io.ReadAll(bb.reader())
+		if err != nil {
+			return r
+		}
+		body = data
+	case hasBody(r):
+		data, err := io.ReadAll(io.LimitReader(r.Body, m.cfg.MaxBodySize+1))
+		r = streamBody(r, bytes.NewReader(data))
+		if err != nil || int64(len(data)) > m.cfg.MaxBodySize {
+			return r
+		}
+		body = data
+	}
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		slog.Debug("mirror busy, not mirroring request", "pool", s.name, "path", r.URL.Path)
+		return r
+	}
+	out := m.request(r, body)
+	go func() {
+		defer func() { <-m.slots }()
+		m.send(out, s.name)
+	}()
+	return r
+}
+
+// request builds the copy of r sent to the shadow backend. It keeps r's
+// Host header, path and query, and is not tied to r's context.
+func (m *mirror) request(r *http.Request, body []byte) *http.Request {
+	u := *m.target
+	u.Path = strings.TrimSuffix(m.target.Path, "/") + r.URL.Path
+	u.RawPath = ""
+	u.RawQuery = r.URL.RawQuery
+	out, _ := http.NewRequestWithContext(context.Background(), r.Method, u.String(), bytes.NewReader(body))
+	out.Header = r.Header.Clone()
+	removeHopHeaders(out.Header)
+	out.Host = r.Host
+	out.ContentLength = int64(len(body))
+	if body == nil {
+		out.Body = http.NoBody
+	}
+	return out
+}
+
+func (m *mirror) send(out *http.Request, pool string) {
+	resp, err := m.client.Do(out)
+	if err != nil {
+		slog.Debug("mirrored request failed", "pool", pool, "path", out.URL.Path, "error", err)
+		return
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+}
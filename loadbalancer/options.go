@@ -0,0 +1,91 @@
+package loadbalancer
+
+import (
+	"net/url"
+	"time"
+)
+
+// Option configures a ServerPool created by NewServerPool.
+type Option func(*ServerPool)
+
+// NewServerPool returns a pool with the same defaults a config file starts
+// from: round-robin balancing, TCP health checks every 30 seconds, passive
+// health checks, slow start and retries. opts are applied in order on top.
+func NewServerPool(opts ...Option) *ServerPool {
+	pc := DefaultConfig().PoolConfig
+	s := &ServerPool{
+		name:             defaultPoolName,
+		algo:             &RoundRobin{},
+		health:           pc.HealthCheck,
+		passive:          pc.PassiveHealthCheck,
+		slowStart:        pc.SlowStart,
+		breaker:          pc.CircuitBreaker,
+		retry:            pc.Retry,
+		requestTimeout:   pc.RequestTimeout,
+		forwardedHeaders: pc.ForwardedHeaders,
+		transportCfg:     pc.Transport,
+		healthInterval:   pc.HealthInterval,
+		healthReset:      make(chan struct{}, 1),
+		discoveryReset:   make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// WithName sets the name the pool is reported under in logs, metrics and
+// the admin API. It defaults to "default".
+func WithName(name string) Option {
+	return func(s *ServerPool) {
+		s.name = name
+	}
+}
+
+func WithAlgorithm(algo Algorithm) Option {
+	return func(s *ServerPool) {
+		s.SetAlgorithm(algo)
+	}
+}
+
+func WithHealthInterval(d time.Duration) Option {
+	return func(s *ServerPool) {
+		s.SetHealthInterval(d)
+	}
+}
+
+// WithHealthTimeout bounds a single health probe.
+func WithHealthTimeout(d time.Duration) Option {
+	return func(s *ServerPool) {
+		hc := s.HealthCheck()
+		hc.Timeout = d
+		s.SetHealthCheck(hc)
+	}
+}
+
+func WithHealthCheck(hc HealthCheck) Option {
+	return func(s *ServerPool) {
+		s.SetHealthCheck(hc)
+	}
+}
+
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(s *ServerPool) {
+		s.SetRetryPolicy(p)
+	}
+}
+
+// WithStateHook registers hook with OnStateChange.
+func WithStateHook(hook StateHook) Option {
+	return func(s *ServerPool) {
+		s.OnStateChange(hook)
+	}
+}
+
+// WithBackend adds a backend at u with weight 1 and no per-backend
+// overrides.
+func WithBackend(u *url.URL) Option {
+	return func(s *ServerPool) {
+		s.AddBackend(newBackend(u, s))
+	}
+}
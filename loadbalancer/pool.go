@@ -0,0 +1,636 @@
+package loadbalancer
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// contextKey is the type of the request context keys set by the pool, so
+// they cannot collide with keys of other packages.
+type contextKey int
+
+const (
+	// Attempts holds how many backends a request has failed over from.
+	Attempts contextKey = iota
+	// Retry holds how often the request has been retried on its current
+	// backend.
+	Retry
+)
+
+type ServerPool struct {
+	name     string
+	mu       sync.RWMutex
+	backends []*Backend
+	// byURL indexes backends by their normalized URL. Like backends, it is
+	// replaced rather than modified.
+	byURL map[string]*Backend
+	algo  Algorithm
+	// algoName is the name algo was configured by, empty when it was set
+	// directly with SetAlgorithm.
+	algoName string
+	sticky   *StickySessions
+	health   HealthCheck
+	passive  PassiveHealthCheck
+	// slowStart is how long a recovered backend takes to ramp up to its full
+	// share of traffic. Zero disables slow start.
+	slowStart time.Duration
+	breaker   CircuitBreaker
+	retry     RetryPolicy
+	// requestTimeout bounds each forwarding attempt. Zero means no timeout.
+	requestTimeout time.Duration
+	// transport is shared by all backends without their own TLS settings.
+	transport    *http.Transport
+	transportCfg TransportConfig
+	upstreamTLS  UpstreamTLSConfig
+	// forwardedHeaders adds X-Forwarded-For, X-Real-IP and
+	// X-Forwarded-Host/Proto to upstream requests.
+	forwardedHeaders bool
+	// debugHeaders reports the serving backend and attempt counts in
+	// response headers.
+	debugHeaders bool
+	// splitter, when set, diverts a share of the pool's requests to a
+	// canary pool.
+	splitter *Splitter
+	// mirror, when set, copies a share of the pool's requests to a shadow
+	// backend.
+	mirror *mirror
+	// errorPage shapes the error responses the pool generates.
+	errorPage ErrorPage
+	// errorMasks replace matching backend responses with errorPage.
+	errorMasks []errorMask
+	// metrics is where the pool's requests are counted; nil discards them.
+	metrics *metrics
+	// events receives the state changes of the pool's backends; nil
+	// discards them.
+	events *eventHub
+	// hooks are called when a backend goes up or down.
+	hooks []StateHook
+	// activeTier is the priority of the backends that may be picked. See
+	// refreshTier.
+	activeTier atomic.Int64
+
+	// healthInterval is the time between active health check sweeps.
+	// healthReset wakes the running loop when it changes.
+	healthInterval time.Duration
+	healthReset    chan struct{}
+	stopHealth     context.CancelFunc
+	healthDone     chan struct{}
+
+	// static are the configured backends and discovered those the
+	// discoverer found last; the pool runs both. reconcileMu serializes
+	// making the backends match them. discoveryReset wakes the running
+	// discovery loop when the discoverer or interval changes.
+	discoverer        Discoverer
+	discoveryInterval time.Duration
+	static            []BackendConfig
+	discovered        []BackendConfig
+	reconcileMu       sync.Mutex
+	discoveryReset    chan struct{}
+	stopDiscovery     context.CancelFunc
+	discoveryDone     chan struct{}
+}
+
+func (s *ServerPool) stats() *metrics {
+	if s.metrics == nil {
+		return discardMetrics
+	}
+	return s.metrics
+}
+
+// Name returns the name the pool is configured under.
+func (s *ServerPool) Name() string {
+	return s.name
+}
+
+// Backends returns the current backend list. The pool never mutates a slice
+// it has handed out, so callers may range over it without holding a lock but
+// must not modify it.
+func (s *ServerPool) Backends() []*Backend {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.backends
+}
+
+// Len returns the number of backends in the pool.
+func (s *ServerPool) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.backends)
+}
+
+// BackendInfo is a point-in-time copy of a backend's state.
+type BackendInfo struct {
+	URL         string            `json:"url"`
+	Alive       bool              `json:"alive"`
+	Draining    bool              `json:"draining"`
+	Weight      int               `json:"weight"`
+	ActiveConns int64             `json:"active_connections"`
+	Priority    int               `json:"priority"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	// LastCheck is nil until the backend has been health checked.
+	LastCheck *CheckInfo `json:"last_check,omitempty"`
+}
+
+// CheckInfo is the serializable form of a CheckResult.
+type CheckInfo struct {
+	At         time.Time `json:"at"`
+	DurationMS float64   `json:"duration_ms"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func checkInfoOf(res CheckResult) *CheckInfo {
+	if res.At.IsZero() {
+		return nil
+	}
+	info := &CheckInfo{At: res.At, DurationMS: float64(res.Duration.Microseconds()) / 1000}
+	if res.Err != nil {
+		info.Error = res.Err.Error()
+	}
+	return info
+}
+
+// Snapshot returns the state of every backend, in pool order. The values are
+// copies, so callers may keep and serialize them freely.
+func (s *ServerPool) Snapshot() []BackendInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	infos := make([]BackendInfo, 0, len(s.backends))
+	for _, b := range s.backends {
+		infos = append(infos, b.info())
+	}
+	return infos
+}
+
+// AddBackend adds backend to the pool unless one with the same URL is
+// already present, and reports whether it was added. An added backend uses
+// the pool's settings from then on.
+func (s *ServerPool) AddBackend(backend *Backend) bool {
+	key := backendKey(backend.url)
+	s.mu.Lock()
+	if _, ok := s.byURL[key]; ok {
+		s.mu.Unlock()
+		return false
+	}
+	backend.pool = s
+	backends := make([]*Backend, len(s.backends), len(s.backends)+1)
+	copy(backends, s.backends)
+	s.backends = append(backends, backend)
+	byURL := make(map[string]*Backend, len(s.byURL)+1)
+	for k, b := range s.byURL {
+		byURL[k] = b
+	}
+	byURL[key] = backend
+	s.byURL = byURL
+	s.mu.Unlock()
+
+	s.rebuild()
+	return true
+}
+
+// RemoveBackend drops the backend with the given URL from the pool, which
+// also takes it out of health checking, and reports whether it was found.
+func (s *ServerPool) RemoveBackend(u *url.URL) bool {
+	key := backendKey(u)
+	s.mu.Lock()
+	_, removed := s.byURL[key]
+	if removed {
+		backends := make([]*Backend, 0, len(s.backends))
+		byURL := make(map[string]*Backend, len(s.byURL))
+		for _, b := range s.backends {
+			if k := backendKey(b.url); k != key {
+				backends = append(backends, b)
+				byURL[k] = b
+			}
+		}
+		s.backends, s.byURL = backends, byURL
+	}
+	s.mu.Unlock()
+
+	if removed {
+		s.rebuild()
+	}
+	return removed
+}
+
+func (s *ServerPool) rebuild() {
+	s.refreshTier()
+	s.mu.RLock()
+	algo := s.algo
+	s.mu.RUnlock()
+	if rb, ok := algo.(Rebuilder); ok {
+		rb.Rebuild(s)
+	}
+	if sticky := s.StickySessions(); sticky != nil {
+		sticky.rebuild(s)
+	}
+}
+
+// observeLatency passes a round-trip time to the algorithm if it balances on
+// response times.
+func (s *ServerPool) observeLatency(b *Backend, d time.Duration) {
+	s.mu.RLock()
+	algo := s.algo
+	s.mu.RUnlock()
+	if lo, ok := algo.(LatencyObserver); ok {
+		lo.ObserveLatency(b, d)
+	}
+}
+
+func (s *ServerPool) SetAlgorithm(algo Algorithm) {
+	s.setAlgorithm(algo, "")
+}
+
+func (s *ServerPool) setAlgorithm(algo Algorithm, name string) {
+	s.mu.Lock()
+	s.algo, s.algoName = algo, name
+	s.mu.Unlock()
+	s.rebuild()
+}
+
+// Algorithm returns the pool's algorithm, nil until one is set or the first
+// request picks the round-robin default.
+func (s *ServerPool) Algorithm() Algorithm {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.algo
+}
+
+// AlgorithmName returns the name of the configured algorithm, or "" when it
+// was set with SetAlgorithm.
+func (s *ServerPool) AlgorithmName() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.algoName
+}
+
+func (s *ServerPool) SetStickySessions(sticky *StickySessions) {
+	s.mu.Lock()
+	s.sticky = sticky
+	s.mu.Unlock()
+}
+
+func (s *ServerPool) StickySessions() *StickySessions {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sticky
+}
+
+func (s *ServerPool) SetHealthCheck(hc HealthCheck) {
+	s.mu.Lock()
+	s.health = hc
+	s.mu.Unlock()
+}
+
+func (s *ServerPool) HealthCheck() HealthCheck {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.health
+}
+
+// SetHealthInterval changes the time between active health check sweeps. A
+// running health check loop picks up the new interval straight away.
+func (s *ServerPool) SetHealthInterval(d time.Duration) {
+	s.mu.Lock()
+	changed := s.healthInterval != d
+	s.healthInterval = d
+	s.mu.Unlock()
+	if changed {
+		s.resetHealthTicker()
+	}
+}
+
+// resetHealthTicker makes the running health check loop pick up a changed
+// interval.
+func (s *ServerPool) resetHealthTicker() {
+	select {
+	case s.healthReset <- struct{}{}:
+	default:
+	}
+}
+
+func (s *ServerPool) HealthInterval() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.healthInterval
+}
+
+func (s *ServerPool) SetPassiveHealthCheck(phc PassiveHealthCheck) {
+	s.mu.Lock()
+	s.passive = phc
+	s.mu.Unlock()
+}
+
+func (s *ServerPool) PassiveHealthCheck() PassiveHealthCheck {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.passive
+}
+
+func (s *ServerPool) SetSlowStart(d time.Duration) {
+	s.mu.Lock()
+	s.slowStart = d
+	s.mu.Unlock()
+}
+
+func (s *ServerPool) SetCircuitBreaker(cb CircuitBreaker) {
+	s.mu.Lock()
+	s.breaker = cb
+	s.mu.Unlock()
+}
+
+func (s *ServerPool) CircuitBreaker() CircuitBreaker {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.breaker
+}
+
+func (s *ServerPool) SetRetryPolicy(p RetryPolicy) {
+	s.mu.Lock()
+	s.retry = p
+	s.mu.Unlock()
+}
+
+func (s *ServerPool) RetryPolicy() RetryPolicy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.retry
+}
+
+func (s *ServerPool) SetRequestTimeout(d time.Duration) {
+	s.mu.Lock()
+	s.requestTimeout = d
+	s.mu.Unlock()
+}
+
+func (s *ServerPool) RequestTimeout() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.requestTimeout
+}
+
+// SetUpstreamTLS rebuilds the shared backend transport from c, unless c is
+// unchanged from the current settings.
+func (s *ServerPool) SetUpstreamTLS(c UpstreamTLSConfig) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rebuildTransport(s.transportCfg, c)
+}
+
+// SetTransportConfig rebuilds the shared backend transport with c's
+// connection pool and timeout settings, unless they are unchanged.
+// Backends with their own TLS settings pick c up when they are next
+// configured.
+func (s *ServerPool) SetTransportConfig(c TransportConfig) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rebuildTransport(c, s.upstreamTLS)
+}
+
+func (s *ServerPool) TransportConfig() TransportConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.transportCfg
+}
+
+// rebuildTransport replaces the shared transport; idle connections of the
+// old one are closed. The caller must hold s.mu.
+func (s *ServerPool) rebuildTransport(tc TransportConfig, c UpstreamTLSConfig) error {
+	if s.transport != nil && s.transportCfg == tc && s.upstreamTLS == c {
+		return nil
+	}
+	t, err := newTransport(tc, c)
+	if err != nil {
+		return err
+	}
+	if s.transport != nil {
+		s.transport.CloseIdleConnections()
+	}
+	s.transport, s.transportCfg, s.upstreamTLS = t, tc, c
+	return nil
+}
+
+// Transport returns the shared transport used to reach backends.
+func (s *ServerPool) Transport() http.RoundTripper {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.transport == nil {
+		return http.DefaultTransport
+	}
+	return s.transport
+}
+
+func (s *ServerPool) SetForwardedHeaders(enabled bool) {
+	s.mu.Lock()
+	s.forwardedHeaders = enabled
+	s.mu.Unlock()
+}
+
+func (s *ServerPool) ForwardedHeaders() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.forwardedHeaders
+}
+
+func (s *ServerPool) SetDebugHeaders(enabled bool) {
+	s.mu.Lock()
+	s.debugHeaders = enabled
+	s.mu.Unlock()
+}
+
+func (s *ServerPool) DebugHeaders() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.debugHeaders
+}
+
+func (s *ServerPool) SetErrorPage(p ErrorPage) {
+	s.mu.Lock()
+	s.errorPage = p
+	s.mu.Unlock()
+}
+
+func (s *ServerPool) ErrorPage() ErrorPage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.errorPage
+}
+
+func (s *ServerPool) SetSplitter(sp *Splitter) {
+	s.mu.Lock()
+	s.splitter = sp
+	s.mu.Unlock()
+}
+
+func (s *ServerPool) Splitter() *Splitter {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.splitter
+}
+
+// IsAvailable reports whether b may be picked for a new request. Algorithms
+// call it once per candidate backend while making a choice.
+func (s *ServerPool) IsAvailable(b *Backend) bool {
+	if !b.IsAlive() || b.IsDraining() || b.AtCapacity() || b.Priority() != s.ActiveTier() {
+		return false
+	}
+	s.mu.RLock()
+	slowStart, breaker := s.slowStart, s.breaker
+	s.mu.RUnlock()
+	return b.circuit.allow(breaker) && b.admitSlowStart(slowStart)
+}
+
+func (s *ServerPool) GetNextPeer(r *http.Request) *Backend {
+	s.mu.RLock()
+	algo, n := s.algo, len(s.backends)
+	s.mu.RUnlock()
+	if n == 0 {
+		return nil
+	}
+	if algo == nil {
+		s.mu.Lock()
+		if s.algo == nil {
+			s.algo = &RoundRobin{}
+		}
+		algo = s.algo
+		s.mu.Unlock()
+	}
+	return algo.Pick(s, r)
+}
+
+// GetBackend returns the backend with the given URL, or nil if it is not in
+// the pool. URLs are compared after normalization, see backendKey.
+func (s *ServerPool) GetBackend(u *url.URL) *Backend {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.byURL[backendKey(u)]
+}
+
+func (s *ServerPool) MarkBackendStatus(url *url.URL, alive bool) {
+	if b := s.GetBackend(url); b != nil {
+		b.SetAlive(alive)
+	}
+}
+
+// backendKey normalizes a backend URL so that addresses differing only in
+// case, an explicit default port or a trailing slash name the same backend.
+func backendKey(u *url.URL) string {
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+		port = ""
+	}
+	if port != "" {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return scheme + "://" + host + strings.TrimRight(u.EscapedPath(), "/")
+}
+
+func GetRetryFromContext(r *http.Request) int {
+	if retry, ok := r.Context().Value(Retry).(int); ok {
+		return retry
+	}
+	return 0
+}
+
+func GetAttemptsFromContext(r *http.Request) int {
+	if attempts, ok := r.Context().Value(Attempts).(int); ok {
+		return attempts
+	}
+	return 0
+}
+
+// ServeHTTP sends the request to one of the pool's backends. It is called
+// again from the proxy's ErrorHandler for every failover attempt. It replies
+// with 503 when no backend can take the request, and with 502 once backends
+// have been tried and failed.
+func (s *ServerPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	attempts := GetAttemptsFromContext(r)
+	if attempts > s.RetryPolicy().MaxAttempts {
+		slog.Warn("max attempts reached, terminating", "remote_addr", r.RemoteAddr, "path", r.URL.Path, "attempt", attempts)
+		s.ErrorPage().write(w, http.StatusBadGateway, "Bad gateway")
+		return
+	}
+	var peer *Backend
+	forced := forcedBackendFrom(r)
+	sticky := s.StickySessions()
+	switch {
+	case forced != nil:
+		if forced.acquire() {
+			peer = forced
+		}
+	case sticky != nil:
+		if peer = sticky.Lookup(s, r); peer != nil && tried(r, peer) {
+			peer = nil
+		}
+	}
+	if forced == nil && (peer == nil || !peer.acquire()) {
+		peer = s.acquirePeer(r)
+	}
+	if peer != nil {
+		defer peer.release()
+		if sticky != nil && forced == nil {
+			w = sticky.Wrap(w, r, peer)
+		}
+		slog.Info("forwarding request", "remote_addr", r.RemoteAddr, "path", r.URL.Path, "pool", s.name, "backend", peer.url.String(), "attempt", attempts, "request_id", requestIDFrom(r))
+		if info := requestInfoFrom(r); info != nil {
+			info.backend = peer.url.String()
+		}
+		traceAttempt(r, s.name, peer, attempts)
+		peer.serve(w, r)
+		return
+	}
+
+	if attempts > 0 {
+		slog.Warn("no backend left to fail over to", "remote_addr", r.RemoteAddr, "path", r.URL.Path, "pool", s.name, "attempt", attempts)
+		s.ErrorPage().write(w, http.StatusBadGateway, "Bad gateway")
+		return
+	}
+	s.ErrorPage().write(w, http.StatusServiceUnavailable, "Service unavailable")
+}
+
+// canFailOver reports whether another backend than from, not yet tried by
+// r, could take r. It checks what IsAvailable checks but, unlike it, neither
+// takes a half-open breaker's probe nor rolls slow start's dice, so a
+// backend ramping up counts.
+func (s *ServerPool) canFailOver(r *http.Request, from *Backend) bool {
+	s.mu.RLock()
+	breaker := s.breaker
+	s.mu.RUnlock()
+	tier := s.ActiveTier()
+	for _, b := range s.Backends() {
+		if b == from || tried(r, b) {
+			continue
+		}
+		if b.IsAlive() && !b.IsDraining() && !b.AtCapacity() && b.Priority() == tier && b.circuit.wouldAllow(breaker) {
+			return true
+		}
+	}
+	return false
+}
+
+// acquirePeer picks a backend and takes a connection slot on it. Another
+// request can fill the backend up between the pick and the acquire, in which
+// case the pick is repeated, at most once per backend. So is a pick of a
+// backend the request already tried, see withTried.
+func (s *ServerPool) acquirePeer(r *http.Request) *Backend {
+	for i := len(s.Backends()); i > 0; i-- {
+		peer := s.GetNextPeer(r)
+		if peer == nil {
+			return nil
+		}
+		if !tried(r, peer) && peer.acquire() {
+			return peer
+		}
+	}
+	return nil
+}
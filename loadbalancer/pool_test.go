@@ -0,0 +1,21 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEmptyPool(t *testing.T) {
+	pool := NewServerPool()
+	r := httptest.NewRequest("GET", "/", nil)
+	if b := pool.GetNextPeer(r); b != nil {
+		t.Fatalf("GetNextPeer on an empty pool = %v, want nil", b.url)
+	}
+
+	w := httptest.NewRecorder()
+	pool.ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", w.Code)
+	}
+}
@@ -0,0 +1,54 @@
+package loadbalancer
+
+import "log/slog"
+
+// SetPriority puts the backend in a failover tier. The pool only sends
+// traffic to the tier with the lowest priority that has a backend up and not
+// draining, so higher numbers are standbys for lower ones. The default is 0.
+func (b *Backend) SetPriority(priority int) {
+	b.mux.Lock()
+	changed := priority != b.priority
+	b.priority = priority
+	b.mux.Unlock()
+	if changed && b.pool != nil {
+		b.pool.refreshTier()
+	}
+}
+
+func (b *Backend) Priority() (priority int) {
+	b.mux.RLock()
+	priority = b.priority
+	b.mux.RUnlock()
+	return
+}
+
+// ActiveTier returns the priority of the backends currently taking traffic.
+func (s *ServerPool) ActiveTier() int {
+	return int(s.activeTier.Load())
+}
+
+// refreshTier recomputes the active tier: the lowest priority with a backend
+// up and not draining, or the lowest priority at all when every backend is
+// out. It is called whenever membership, priorities or those states change,
+// so picking a backend does not have to scan the pool.
+func (s *ServerPool) refreshTier() {
+	var tier, lowest int
+	found, any := false, false
+	for _, b := range s.Backends() {
+		b.mux.RLock()
+		priority, up := b.priority, b.isAlive && !b.draining
+		b.mux.RUnlock()
+		if !any || priority < lowest {
+			lowest, any = priority, true
+		}
+		if up && (!found || priority < tier) {
+			tier, found = priority, true
+		}
+	}
+	if !found {
+		tier = lowest
+	}
+	if old := s.activeTier.Swap(int64(tier)); old != int64(tier) && any {
+		slog.Info("active tier changed", "pool", s.name, "from", old, "to", tier)
+	}
+}
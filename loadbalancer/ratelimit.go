@@ -0,0 +1,124 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimitConfig limits how fast a single client IP may send requests using
+// a token bucket per client: Burst requests may arrive at once, refilled at
+// Rate per second. A zero Rate disables rate limiting.
+type RateLimitConfig struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+	// IdleTimeout is how long the bucket of a client that stopped sending
+	// requests is kept before it is evicted.
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+	// UseXFF keys clients on the first X-Forwarded-For address instead of
+	// the connection's remote address. Only enable it behind a trusted proxy.
+	UseXFF bool `yaml:"use_x_forwarded_for"`
+}
+
+func (c RateLimitConfig) Enabled() bool {
+	return c.Rate > 0
+}
+
+func (c RateLimitConfig) validate() error {
+	if c.Rate < 0 {
+		return fmt.Errorf("rate must not be negative, got %g", c.Rate)
+	}
+	if c.Enabled() && c.Burst < 1 {
+		return fmt.Errorf("burst must be at least 1, got %d", c.Burst)
+	}
+	if c.Enabled() && c.IdleTimeout <= 0 {
+		return fmt.Errorf("idle_timeout must be positive, got %s", c.IdleTimeout)
+	}
+	return nil
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter holds one token bucket per client IP.
+type rateLimiter struct {
+	cfg RateLimitConfig
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func newRateLimiter(cfg RateLimitConfig) *rateLimiter {
+	return &rateLimiter{cfg: cfg, buckets: make(map[string]*bucket)}
+}
+
+// allow takes a token from the client's bucket and reports whether there was
+// one to take.
+func (l *rateLimiter) allow(client string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: float64(l.cfg.Burst), last: now}
+		l.buckets[client] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.cfg.Rate
+	if burst := float64(l.cfg.Burst); b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// evict drops the buckets of clients idle for longer than the idle timeout.
+// Such a bucket has refilled completely, so forgetting it changes nothing.
+func (l *rateLimiter) evict(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for client, b := range l.buckets {
+		if now.Sub(b.last) > l.cfg.IdleTimeout {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// run evicts idle buckets every idle timeout until ctx is cancelled.
+func (l *rateLimiter) run(ctx context.Context) {
+	t := time.NewTicker(l.cfg.IdleTimeout)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			l.evict(now)
+		}
+	}
+}
+
+// rateLimit rejects requests from clients over their limit with 429 before
+// they reach next, writing the response with reject.
+func rateLimit(next http.Handler, l *rateLimiter, m *metrics, reject func(http.ResponseWriter, int, string)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := clientIP(r, l.cfg.UseXFF)
+		if !l.allow(client, time.Now()) {
+			m.rateLimited.Inc()
+			slog.Warn("rate limit exceeded", "remote_addr", r.RemoteAddr, "client", client, "path", r.URL.Path)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(1/l.cfg.Rate))))
+			reject(w, http.StatusTooManyRequests, "Too many requests")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,37 @@
+package loadbalancer
+
+import (
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+)
+
+// recoverPanics turns a panic in next into a 500 for the request that caused
+// it, logged with its stack and request ID, instead of a dropped connection.
+// Once the response has started only the log is left. http.ErrAbortHandler,
+// which the reverse proxy panics with to abort a broken response, is passed
+// on. requestIDHeader is the response header the request ID middleware
+// sets, empty when it is off.
+func recoverPanics(next http.Handler, requestIDHeader string, writeError func(http.ResponseWriter, int, string)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rt := &responseTracker{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			id := requestIDFrom(r)
+			if id == "" && requestIDHeader != "" {
+				id = w.Header().Get(requestIDHeader)
+			}
+			slog.Error("panic serving request", "remote_addr", r.RemoteAddr, "path", r.URL.Path, "request_id", id, "panic", v, "stack", string(debug.Stack()))
+			if !rt.started {
+				writeError(w, http.StatusInternalServerError, "Internal server error")
+			}
+		}()
+		next.ServeHTTP(rt, r)
+	})
+}
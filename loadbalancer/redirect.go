@@ -0,0 +1,68 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// RedirectHTTPConfig runs a plaintext listener on Listen that redirects
+// every request to its HTTPS equivalent. It is disabled when Listen is
+// empty. Status is 301, the default, or 308; 308 makes clients repeat a
+// POST with its body instead of turning it into a GET. Port is the HTTPS
+// port redirected to and defaults to that of the first TLS listener.
+type RedirectHTTPConfig struct {
+	Listen string `yaml:"listen"`
+	Status int    `yaml:"status"`
+	Port   string `yaml:"port"`
+}
+
+func (c RedirectHTTPConfig) validate() error {
+	if c.Listen == "" {
+		return nil
+	}
+	if c.Status != http.StatusMovedPermanently && c.Status != http.StatusPermanentRedirect {
+		return fmt.Errorf("status must be %d or %d, got %d", http.StatusMovedPermanently, http.StatusPermanentRedirect, c.Status)
+	}
+	return nil
+}
+
+// RedirectPort returns the port requests are redirected to, "" if no
+// listener has TLS enabled.
+func (c Config) RedirectPort() string {
+	if c.RedirectHTTP.Port != "" {
+		return c.RedirectHTTP.Port
+	}
+	for _, l := range c.AllListeners() {
+		if l.TLS.Enabled() {
+			_, port, _ := net.SplitHostPort(l.Listen)
+			return port
+		}
+	}
+	return ""
+}
+
+// RedirectHandler redirects requests with code to the same host, path and
+// query over HTTPS on port. The port is left out of the URL when it is 443
+// or empty.
+func RedirectHandler(port string, code int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if host == "" {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		if port != "" && port != "443" {
+			host += ":" + port
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, code)
+	})
+}
@@ -0,0 +1,62 @@
+package loadbalancer
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// RequestIDConfig tags every request with an ID that is sent to the
+// backend, echoed on the response and included in the logs.
+type RequestIDConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Header carries the ID. It defaults to X-Request-ID.
+	Header string `yaml:"header"`
+	// Generate creates an ID for requests that arrive without one. When
+	// false, only IDs supplied by clients are passed along.
+	Generate bool `yaml:"generate"`
+}
+
+func (c RequestIDConfig) validate() error {
+	if c.Enabled && c.Header == "" {
+		return errors.New("header is required")
+	}
+	return nil
+}
+
+type requestIDKey struct{}
+
+// requestIDFrom returns the ID assigned to r, or "" if it has none.
+func requestIDFrom(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// newRequestID returns a random version 4 UUID.
+func newRequestID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// requestID keeps the client's ID from the configured header, or generates
+// one, and makes it available to the rest of the chain.
+func requestID(next http.Handler, cfg RequestIDConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(cfg.Header)
+		if id == "" && cfg.Generate {
+			id = newRequestID()
+			r.Header.Set(cfg.Header, id)
+		}
+		if id == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set(cfg.Header, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
@@ -0,0 +1,163 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RetryPolicy controls how a failed forward is retried. A failed request is
+// first retried against the same backend up to Retries times, waiting an
+// exponentially growing, jittered delay between tries. After that the
+// backend is marked down and the request fails over to another backend, up
+// to MaxAttempts times. Zero disables the corresponding stage.
+//
+// Only requests whose method is in Methods are retried or failed over, which
+// by default leaves out POST and PATCH so they are never sent twice. Other
+// failed requests get a 502, or a 504 when they timed out.
+//
+// A forward fails when the backend cannot be reached or, if its status is
+// in OnStatus, when it answers with that status. Such a response is retried
+// and failed over like an unreachable backend, except that it does not
+// count against the backend: the backend stays up, its breaker and passive
+// health check are untouched and failing over just moves on to a backend
+// the request has not tried yet. The response is only discarded while
+// another try is left, on the same backend or on an untried one that could
+// take the request; otherwise it is passed on to the client as is.
+type RetryPolicy struct {
+	Retries     int           `yaml:"retries"`
+	MaxAttempts int           `yaml:"max_attempts"`
+	BaseDelay   time.Duration `yaml:"base_delay"`
+	MaxDelay    time.Duration `yaml:"max_delay"`
+	Methods     []string      `yaml:"methods"`
+	OnStatus    []int         `yaml:"on_status"`
+}
+
+// statusError is the failure of a forward whose response had a status in
+// RetryPolicy.OnStatus.
+type statusError struct {
+	code int
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("upstream returned status %d", e.code)
+}
+
+// retryStatus returns the error resp, from b, should fail its forward with,
+// or nil to pass it on: its status is not in OnStatus, r may not be sent
+// again or no try is left, including when failing over would find no other
+// backend to take the request.
+func (p RetryPolicy) retryStatus(resp *http.Response, b *Backend) error {
+	r := resp.Request
+	retryable := false
+	for _, code := range p.OnStatus {
+		if resp.StatusCode == code {
+			retryable = true
+			break
+		}
+	}
+	if !retryable || !p.allows(r.Method) || !canReplay(r) {
+		return nil
+	}
+	// Forced requests do not fail over, see DebugRoutingConfig.
+	lastBackend := forcedBackendFrom(r) != nil || GetAttemptsFromContext(r) >= p.MaxAttempts
+	if GetRetryFromContext(r) < p.Retries {
+		return statusError{code: resp.StatusCode}
+	}
+	if lastBackend || !b.pool.canFailOver(r, b) {
+		return nil
+	}
+	return statusError{code: resp.StatusCode}
+}
+
+type triedBackendsKey struct{}
+
+// withTried returns ctx noting that b has been tried, so that failing over
+// from a backend that is not marked down does not pick it again.
+func withTried(ctx context.Context, b *Backend) context.Context {
+	prev, _ := ctx.Value(triedBackendsKey{}).([]*Backend)
+	tried := append(prev[:len(prev):len(prev)], b)
+	return context.WithValue(ctx, triedBackendsKey{}, tried)
+}
+
+// tried reports whether r has already been tried against b.
+func tried(r *http.Request, b *Backend) bool {
+	bs, _ := r.Context().Value(triedBackendsKey{}).([]*Backend)
+	for _, t := range bs {
+		if t == b {
+			return true
+		}
+	}
+	return false
+}
+
+func defaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Retries:     3,
+		MaxAttempts: 3,
+		BaseDelay:   10 * time.Millisecond,
+		MaxDelay:    time.Second,
+		Methods: []string{
+			http.MethodGet,
+			http.MethodHead,
+			http.MethodOptions,
+			http.MethodTrace,
+			http.MethodPut,
+			http.MethodDelete,
+		},
+	}
+}
+
+// allows reports whether requests with the given method may be retried.
+func (p RetryPolicy) allows(method string) bool {
+	for _, m := range p.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p RetryPolicy) validate() error {
+	if p.Retries < 0 {
+		return fmt.Errorf("retries must not be negative, got %d", p.Retries)
+	}
+	if p.MaxAttempts < 0 {
+		return fmt.Errorf("max_attempts must not be negative, got %d", p.MaxAttempts)
+	}
+	if p.BaseDelay < 0 || p.MaxDelay < 0 {
+		return fmt.Errorf("delays must not be negative")
+	}
+	for _, m := range p.Methods {
+		if m == "" || strings.ContainsAny(m, " \t") {
+			return fmt.Errorf("invalid method %q", m)
+		}
+	}
+	for _, code := range p.OnStatus {
+		if code < 100 || code > 599 {
+			return fmt.Errorf("on_status: invalid status %d", code)
+		}
+	}
+	return nil
+}
+
+// backoff returns the delay before the given retry, counting from zero. The
+// delay doubles with every retry up to MaxDelay, and a random half of it is
+// jittered away so concurrent retries do not arrive in lockstep.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	d := p.BaseDelay
+	for i := 0; i < retry && (p.MaxDelay <= 0 || d < p.MaxDelay); i++ {
+		d *= 2
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
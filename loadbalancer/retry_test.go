@@ -0,0 +1,87 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryOnStatusDoesNotFailBackend(t *testing.T) {
+	var unavailable, ok atomic.Int64
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		unavailable.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer flaky.Close()
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok.Add(1)
+	}))
+	defer healthy.Close()
+
+	lb, srv := newTestLB(t, []string{flaky.URL, healthy.URL}, func(c *Config) {
+		c.Retry.Retries = 1
+		c.Retry.BaseDelay = time.Millisecond
+		c.Retry.OnStatus = []int{http.StatusServiceUnavailable}
+		c.CircuitBreaker.MaxFailures = 1
+		c.PassiveHealthCheck.MaxFailures = 1
+	})
+	const requests = 4
+	for i := 0; i < requests; i++ {
+		if resp := get(t, srv, "/"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want 200", resp.StatusCode)
+		}
+	}
+	if n := ok.Load(); n != requests {
+		t.Errorf("healthy backend served %d requests, want %d", n, requests)
+	}
+	// The backend answering 503 stays in rotation, and every request sent to
+	// it is retried there once before failing over.
+	if n := unavailable.Load(); n == 0 || n%2 != 0 {
+		t.Errorf("flaky backend got %d tries, want two per request picking it", n)
+	}
+
+	u, err := parseBackendURL(flaky.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := lb.Router().DefaultPool().GetBackend(u)
+	if !b.IsAlive() {
+		t.Error("backend answering an on_status code was marked down")
+	}
+	if state := b.circuit.State(); state != breakerClosed {
+		t.Errorf("breaker is %s, want closed", state)
+	}
+	if n := b.consecutiveFailures(); n != 0 {
+		t.Errorf("passive health check counted %d failures", n)
+	}
+}
+
+func TestRetryOnStatusPassesLastResponseOn(t *testing.T) {
+	var tries atomic.Int64
+	restarting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tries.Add(1)
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer restarting.Close()
+
+	_, srv := newTestLB(t, []string{restarting.URL}, func(c *Config) {
+		c.Retry.Retries = 1
+		c.Retry.BaseDelay = time.Millisecond
+		c.Retry.OnStatus = []int{http.StatusServiceUnavailable}
+	})
+	resp := get(t, srv, "/")
+	// With no other backend to fail over to, the retried backend's own
+	// answer reaches the client rather than the load balancer's 502.
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want the upstream 503", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "5" {
+		t.Errorf("Retry-After = %q, want the upstream's %q", got, "5")
+	}
+	if n := tries.Load(); n != 2 {
+		t.Errorf("backend got %d tries, want 2", n)
+	}
+}
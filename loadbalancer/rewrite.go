@@ -0,0 +1,68 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// PathRewrite maps the client-facing path onto the path a backend serves
+// it under. StripPrefix is removed first, when the path starts with it as a
+// whole segment, then AddPrefix is prepended. With StripPrefix "/api" and
+// AddPrefix "/v2", "/api/users?id=1" becomes "/v2/users?id=1". The query
+// is never touched.
+type PathRewrite struct {
+	StripPrefix string `yaml:"strip_prefix"`
+	AddPrefix   string `yaml:"add_prefix"`
+}
+
+func (pr PathRewrite) validate() error {
+	for _, p := range []string{pr.StripPrefix, pr.AddPrefix} {
+		if p != "" && !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("prefix %q must start with /", p)
+		}
+	}
+	return nil
+}
+
+// apply rewrites u's path in place. The escaped form, when u keeps one, is
+// rewritten alongside so encoded characters survive.
+func (pr PathRewrite) apply(u *url.URL) {
+	if pr.StripPrefix == "" && pr.AddPrefix == "" {
+		return
+	}
+	u.Path = pr.rewrite(u.Path)
+	if u.RawPath != "" {
+		u.RawPath = pr.rewrite(u.RawPath)
+	}
+}
+
+func (pr PathRewrite) rewrite(path string) string {
+	if strip := strings.TrimSuffix(pr.StripPrefix, "/"); strip != "" {
+		if rest, ok := strings.CutPrefix(path, strip); ok && (rest == "" || rest[0] == '/') {
+			path = rest
+		}
+	}
+	if add := strings.TrimSuffix(pr.AddPrefix, "/"); add != "" {
+		path = add + path
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+// SetPathRewrite changes how the paths of requests to the backend are
+// rewritten. The zero PathRewrite passes them on unchanged.
+func (b *Backend) SetPathRewrite(pr PathRewrite) {
+	b.mux.Lock()
+	b.pathRewrite = pr
+	b.mux.Unlock()
+}
+
+func (b *Backend) PathRewrite() (pr PathRewrite) {
+	b.mux.RLock()
+	pr = b.pathRewrite
+	b.mux.RUnlock()
+	return
+}
@@ -0,0 +1,153 @@
+package loadbalancer
+
+import (
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Route sends requests whose path starts with Prefix to Pool.
+type Route struct {
+	Prefix string
+	Pool   *ServerPool
+	// MaxBodySize overrides the load balancer's request body limit for the
+	// route when positive.
+	MaxBodySize int64
+}
+
+// HeaderRule sends requests with a Header value equal to Value, or matching
+// Regex when it is set, to Pool.
+type HeaderRule struct {
+	Header string
+	Value  string
+	Regex  *regexp.Regexp
+	Pool   *ServerPool
+}
+
+func (hr *HeaderRule) matches(r *http.Request) bool {
+	for _, v := range r.Header.Values(hr.Header) {
+		if hr.Regex != nil && hr.Regex.MatchString(v) || hr.Regex == nil && v == hr.Value {
+			return true
+		}
+	}
+	return false
+}
+
+// Router picks the pool that serves a request. The first matching header
+// rule wins; then a pool mapped to the request's host; otherwise the route
+// with the longest matching path prefix. Requests matching none of them go
+// to the default pool, or get a 404 when there is none.
+type Router struct {
+	mu     sync.RWMutex
+	pools  map[string]*ServerPool
+	rules  []HeaderRule
+	routes []Route
+	// hosts maps lower-case host names without a port to pools.
+	hosts       map[string]*ServerPool
+	defaultPool *ServerPool
+}
+
+// Update replaces the router's pools, header rules, routes, host mappings
+// and default pool, and returns the pools that are no longer present.
+func (rt *Router) Update(pools map[string]*ServerPool, rules []HeaderRule, routes []Route, hosts map[string]*ServerPool, defaultPool *ServerPool) []*ServerPool {
+	sorted := make([]Route, len(routes))
+	copy(sorted, routes)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i].Prefix) > len(sorted[j].Prefix)
+	})
+	byHost := make(map[string]*ServerPool, len(hosts))
+	for host, pool := range hosts {
+		byHost[normalizeHost(host)] = pool
+	}
+
+	rt.mu.Lock()
+	var removed []*ServerPool
+	for name, pool := range rt.pools {
+		if pools[name] != pool {
+			removed = append(removed, pool)
+		}
+	}
+	rt.pools, rt.rules, rt.routes, rt.hosts, rt.defaultPool = pools, rules, sorted, byHost, defaultPool
+	rt.mu.Unlock()
+	return removed
+}
+
+// Match returns the pool for r, or nil if no host or route matches and
+// there is no default pool. A pool with a canary splitter may hand the
+// request on to its canary pool.
+func (rt *Router) Match(r *http.Request) *ServerPool {
+	pool, _ := rt.matchRoute(r)
+	return pool
+}
+
+// matchRoute is Match, also returning the route that matched. The route is
+// nil when the pool was picked by header rule or host, or is the default
+// pool.
+func (rt *Router) matchRoute(r *http.Request) (*ServerPool, *Route) {
+	pool, route := rt.match(r)
+	if pool == nil {
+		return nil, nil
+	}
+	if sp := pool.Splitter(); sp != nil && sp.divert() {
+		return sp.Canary(), route
+	}
+	return pool, route
+}
+
+func (rt *Router) match(r *http.Request) (*ServerPool, *Route) {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	for i := range rt.rules {
+		if rt.rules[i].matches(r) {
+			return rt.rules[i].Pool, nil
+		}
+	}
+	if pool, ok := rt.hosts[normalizeHost(r.Host)]; ok {
+		return pool, nil
+	}
+	for i := range rt.routes {
+		if route := &rt.routes[i]; strings.HasPrefix(r.URL.Path, route.Prefix) {
+			return route.Pool, route
+		}
+	}
+	return rt.defaultPool, nil
+}
+
+// Pool returns the pool with the given name, or nil if there is none.
+func (rt *Router) Pool(name string) *ServerPool {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	return rt.pools[name]
+}
+
+// DefaultPool returns the pool serving requests that match no route.
+func (rt *Router) DefaultPool() *ServerPool {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	return rt.defaultPool
+}
+
+// Pools returns all pools ordered by name.
+func (rt *Router) Pools() []*ServerPool {
+	rt.mu.RLock()
+	pools := make([]*ServerPool, 0, len(rt.pools))
+	for _, pool := range rt.pools {
+		pools = append(pools, pool)
+	}
+	rt.mu.RUnlock()
+	sort.Slice(pools, func(i, j int) bool {
+		return pools[i].name < pools[j].name
+	})
+	return pools
+}
+
+// normalizeHost lower-cases host and strips the port from it, if any.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
@@ -0,0 +1,257 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+)
+
+const (
+	defaultAffinityCookie = "lb_affinity"
+	defaultAffinityHeader = "X-LB-Affinity"
+)
+
+// Affinity sources, tried in the order StickySessions.Sources lists them.
+const (
+	// AffinityCookie follows the affinity cookie set on an earlier
+	// response.
+	AffinityCookie = "cookie"
+	// AffinityHeader follows the affinity token a client echoes back in a
+	// request header, for clients that do not keep cookies.
+	AffinityHeader = "header"
+	// AffinityHash maps the client onto a consistent hash ring, so clients
+	// without a token still keep landing on the same backend. When that
+	// backend is unavailable the next one on the ring is used, and only
+	// its clients move.
+	AffinityHash = "hash"
+)
+
+// StickyConfig configures sticky sessions for a pool; see StickySessions.
+type StickyConfig struct {
+	Sources    []string `yaml:"sources"`
+	CookieName string   `yaml:"cookie_name"`
+	Header     string   `yaml:"header"`
+	HashHeader string   `yaml:"hash_header"`
+}
+
+func (c *StickyConfig) validate() error {
+	if c == nil {
+		return nil
+	}
+	seen := make(map[string]bool, len(c.Sources))
+	for _, src := range c.Sources {
+		switch src {
+		case AffinityCookie, AffinityHeader, AffinityHash:
+		default:
+			return fmt.Errorf("unknown source %q, want %q, %q or %q", src, AffinityCookie, AffinityHeader, AffinityHash)
+		}
+		if seen[src] {
+			return fmt.Errorf("source %q is listed twice", src)
+		}
+		seen[src] = true
+	}
+	return nil
+}
+
+func (c *StickyConfig) sessions() *StickySessions {
+	if c == nil {
+		return nil
+	}
+	return &StickySessions{
+		Sources:    append([]string(nil), c.Sources...),
+		CookieName: c.CookieName,
+		Header:     c.Header,
+		HashHeader: c.HashHeader,
+	}
+}
+
+// StickySessions pins clients to a backend. Each of Sources, by default
+// just the cookie, is asked in turn for an available backend, and the
+// algorithm picks one when none has. The cookie source sets a cookie on
+// every response naming the backend that served it, and the header source
+// a response header of the same name as the request header it reads. Both
+// carry a hash of the backend URL so the internal topology is not exposed
+// to clients. The hash source keys on the client IP, or on HashHeader when
+// it is set. A StickySessions belongs to a single pool.
+type StickySessions struct {
+	CookieName string
+	Sources    []string
+	// Header names the request and response header of the header source.
+	// It defaults to X-LB-Affinity.
+	Header     string
+	HashHeader string
+
+	ringOnce sync.Once
+	ring     *ConsistentHash
+}
+
+func (s *StickySessions) sources() []string {
+	if len(s.Sources) == 0 {
+		return []string{AffinityCookie}
+	}
+	return s.Sources
+}
+
+func (s *StickySessions) uses(source string) bool {
+	for _, src := range s.sources() {
+		if src == source {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *StickySessions) header() string {
+	if s.Header == "" {
+		return defaultAffinityHeader
+	}
+	return s.Header
+}
+
+func (s *StickySessions) hashRing() *ConsistentHash {
+	s.ringOnce.Do(func() {
+		s.ring = &ConsistentHash{Header: s.HashHeader}
+	})
+	return s.ring
+}
+
+// rebuild updates the hash ring after the pool's membership changed. A ring
+// that was never built is left for the first lookup to build.
+func (s *StickySessions) rebuild(pool *ServerPool) {
+	if s.uses(AffinityHash) {
+		s.hashRing().Rebuild(pool)
+	}
+}
+
+func (s *StickySessions) cookieName() string {
+	if s.CookieName == "" {
+		return defaultAffinityCookie
+	}
+	return s.CookieName
+}
+
+func affinityToken(b *Backend) string {
+	sum := sha256.Sum256([]byte(b.url.String()))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Lookup returns the backend the first source able to name an available
+// one picks, or nil if none can. A token naming a backend the algorithms
+// would skip, as ServerPool.IsAvailable decides, is passed over: one that
+// is down, draining, at its connection cap, behind an open breaker, still
+// ramping up after slow start or outside the active priority tier.
+func (s *StickySessions) Lookup(pool *ServerPool, r *http.Request) *Backend {
+	for _, src := range s.sources() {
+		var b *Backend
+		switch src {
+		case AffinityCookie:
+			if c, err := r.Cookie(s.cookieName()); err == nil {
+				b = lookupToken(pool, c.Value)
+			}
+		case AffinityHeader:
+			b = lookupToken(pool, r.Header.Get(s.header()))
+		case AffinityHash:
+			b = s.hashRing().Pick(pool, r)
+		}
+		if b != nil {
+			return b
+		}
+	}
+	return nil
+}
+
+// lookupToken returns the backend whose affinity token is token, if it can
+// take the request.
+func lookupToken(pool *ServerPool, token string) *Backend {
+	if token == "" {
+		return nil
+	}
+	for _, b := range pool.Backends() {
+		if affinityToken(b) == token {
+			if pool.IsAvailable(b) {
+				return b
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// Wrap returns a ResponseWriter that issues the affinity cookie or header
+// for b, as the sources call for, when the response headers are written. If
+// w already wraps one, possibly under other writers as happens when a
+// failed request is handed to another backend, the existing wrapper is
+// re-pointed at b instead and w is returned as is.
+func (s *StickySessions) Wrap(w http.ResponseWriter, r *http.Request, b *Backend) http.ResponseWriter {
+	for inner := w; inner != nil; {
+		if aw, ok := inner.(*affinityWriter); ok {
+			aw.backend = b
+			return w
+		}
+		u, ok := inner.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			break
+		}
+		inner = u.Unwrap()
+	}
+	current := ""
+	if c, err := r.Cookie(s.cookieName()); err == nil {
+		current = c.Value
+	}
+	return &affinityWriter{ResponseWriter: w, sticky: s, current: current, backend: b}
+}
+
+type affinityWriter struct {
+	http.ResponseWriter
+	sticky      *StickySessions
+	current     string
+	backend     *Backend
+	wroteHeader bool
+}
+
+func (w *affinityWriter) setCookie() {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	token := affinityToken(w.backend)
+	if w.sticky.uses(AffinityHeader) {
+		w.ResponseWriter.Header().Set(w.sticky.header(), token)
+	}
+	if w.sticky.uses(AffinityCookie) && token != w.current {
+		http.SetCookie(w.ResponseWriter, &http.Cookie{
+			Name:     w.sticky.cookieName(),
+			Value:    token,
+			Path:     "/",
+			HttpOnly: true,
+		})
+	}
+}
+
+func (w *affinityWriter) WriteHeader(code int) {
+	w.setCookie()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Hijack hands over the connection for a protocol upgrade. The proxy writes
+// the 101 response itself, including the headers set so far, so the cookie
+// is set first.
+func (w *affinityWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.setCookie()
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+func (w *affinityWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *affinityWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
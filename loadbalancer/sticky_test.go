@@ -0,0 +1,85 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStickyFailoverRepointsAffinity(t *testing.T) {
+	live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer live.Close()
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	dead.Close()
+
+	lb, srv := newTestLB(t, []string{live.URL, dead.URL}, func(c *Config) {
+		c.Retry.Retries = 0
+		c.Sticky = &StickyConfig{Sources: []string{AffinityCookie, AffinityHeader}}
+	})
+	pool := lb.Router().DefaultPool()
+	token := func(rawURL string) string {
+		u, err := parseBackendURL(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return affinityToken(pool.GetBackend(u))
+	}
+	liveToken, deadToken := token(live.URL), token(dead.URL)
+
+	tests := []struct {
+		name string
+		pin  func(*http.Request)
+	}{
+		{"cookie", func(r *http.Request) { r.AddCookie(&http.Cookie{Name: defaultAffinityCookie, Value: deadToken}) }},
+		{"header", func(r *http.Request) { r.Header.Set(defaultAffinityHeader, deadToken) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Each run starts with the dead backend up again, so the pinned
+			// request reaches it and fails over.
+			for _, b := range pool.Backends() {
+				b.SetAlive(true)
+			}
+			req, err := http.NewRequest("GET", srv.URL+"/", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.pin(req)
+			resp, err := srv.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want 200", resp.StatusCode)
+			}
+			if got := resp.Header.Values(defaultAffinityHeader); len(got) != 1 || got[0] != liveToken {
+				t.Errorf("%s = %q, want just the serving backend's token %q", defaultAffinityHeader, got, liveToken)
+			}
+			cookies := resp.Cookies()
+			if len(cookies) != 1 || cookies[0].Value != liveToken {
+				t.Errorf("cookies = %v, want one naming the serving backend %q", cookies, liveToken)
+			}
+		})
+	}
+}
+
+func TestStickyTokenSkipsOpenBreaker(t *testing.T) {
+	pool := newTestPool(t, "round-robin", 2)
+	cb := CircuitBreaker{MaxFailures: 1, Cooldown: time.Minute}
+	pool.SetCircuitBreaker(cb)
+	sticky := &StickySessions{Sources: []string{AffinityHeader}}
+	pinned := pool.Backends()[0]
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(defaultAffinityHeader, affinityToken(pinned))
+	if got := sticky.Lookup(pool, r); got != pinned {
+		t.Fatalf("Lookup = %v, want the pinned backend", got)
+	}
+	pinned.circuit.failure(cb)
+	if got := sticky.Lookup(pool, r); got != nil {
+		t.Fatalf("Lookup = %s, want nil while the pinned backend's breaker is open", got.url)
+	}
+}
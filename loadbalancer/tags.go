@@ -0,0 +1,108 @@
+package loadbalancer
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SetTags replaces the backend's tags, free-form labels such as zone or
+// version that routing and the status output can use. tags is copied.
+func (b *Backend) SetTags(tags map[string]string) {
+	copied := make(map[string]string, len(tags))
+	for k, v := range tags {
+		copied[k] = v
+	}
+	b.mux.Lock()
+	b.tags = copied
+	b.mux.Unlock()
+}
+
+// Tags returns a copy of the backend's tags.
+func (b *Backend) Tags() map[string]string {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.tagsLocked()
+}
+
+func (b *Backend) tagsLocked() map[string]string {
+	if len(b.tags) == 0 {
+		return nil
+	}
+	tags := make(map[string]string, len(b.tags))
+	for k, v := range b.tags {
+		tags[k] = v
+	}
+	return tags
+}
+
+// Tag returns the value of one of the backend's tags, "" if it is not set.
+func (b *Backend) Tag(key string) string {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.tags[key]
+}
+
+// tagLabel turns a tag key into a Prometheus label name. Keys that clash
+// with the labels every backend metric has get a tag_ prefix.
+func tagLabel(key string) string {
+	var sb strings.Builder
+	for i, r := range key {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_':
+			sb.WriteRune(r)
+		case r >= '0' && r <= '9' && i > 0:
+			sb.WriteRune(r)
+		default:
+			sb.WriteByte('_')
+		}
+	}
+	label := sb.String()
+	if label == "pool" || label == "backend" || strings.HasPrefix(label, "__") {
+		label = "tag_" + label
+	}
+	return label
+}
+
+// backendInfoCollector exports the tags of every backend as the labels of
+// lb_backend_info. The label set depends on the tags configured, so the
+// collector is unchecked: it describes nothing up front.
+type backendInfoCollector struct {
+	router *Router
+}
+
+func (c backendInfoCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (c backendInfoCollector) Collect(ch chan<- prometheus.Metric) {
+	var backends []*Backend
+	keys := map[string]string{}
+	for _, pool := range c.router.Pools() {
+		for _, b := range pool.Backends() {
+			backends = append(backends, b)
+			for k := range b.Tags() {
+				keys[tagLabel(k)] = k
+			}
+		}
+	}
+	// Every series of the family carries the same labels; backends without
+	// a tag get an empty value for it.
+	labels := make([]string, 0, len(keys))
+	for label := range keys {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	desc := prometheus.NewDesc(
+		"lb_backend_info",
+		"Always 1; the labels carry the backend's tags.",
+		append([]string{"pool", "backend"}, labels...), nil,
+	)
+	for _, b := range backends {
+		tags := b.Tags()
+		values := []string{b.pool.name, b.url.String()}
+		for _, label := range labels {
+			values = append(values, tags[keys[label]])
+		}
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, 1, values...)
+	}
+}
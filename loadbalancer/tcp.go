@@ -0,0 +1,202 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TCPProxyConfig configures a raw TCP listener whose connections are
+// forwarded byte for byte to the backends of Pool. Backend URLs only need a
+// scheme and a host:port, e.g. tcp://db1:5432.
+type TCPProxyConfig struct {
+	Listen string `yaml:"listen"`
+	Pool   string `yaml:"pool"`
+	// DialTimeout bounds connecting to a backend before trying another one.
+	// It defaults to five seconds.
+	DialTimeout time.Duration `yaml:"dial_timeout"`
+}
+
+func (c TCPProxyConfig) validate() error {
+	if c.Listen == "" {
+		return fmt.Errorf("listen address must not be empty")
+	}
+	if c.DialTimeout < 0 {
+		return fmt.Errorf("dial_timeout must not be negative, got %s", c.DialTimeout)
+	}
+	return nil
+}
+
+const defaultDialTimeout = 5 * time.Second
+
+// TCPProxy accepts TCP connections and splices each one to a backend picked
+// by the pool. It reuses the pool's algorithm, health state, connection caps,
+// passive health checks and circuit breakers, but none of the HTTP machinery.
+type TCPProxy struct {
+	cfg     TCPProxyConfig
+	router  *Router
+	metrics *metrics
+
+	ln    net.Listener
+	wg    sync.WaitGroup
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func newTCPProxy(cfg TCPProxyConfig, router *Router, m *metrics) *TCPProxy {
+	if cfg.DialTimeout == 0 {
+		cfg.DialTimeout = defaultDialTimeout
+	}
+	return &TCPProxy{cfg: cfg, router: router, metrics: m, conns: make(map[net.Conn]struct{})}
+}
+
+// Addr returns the address the proxy listens on.
+func (p *TCPProxy) Addr() string {
+	return p.cfg.Listen
+}
+
+// Pool returns the name of the pool the proxy forwards to.
+func (p *TCPProxy) Pool() string {
+	return p.cfg.Pool
+}
+
+// ListenAndServe accepts connections until Shutdown is called.
+func (p *TCPProxy) ListenAndServe() error {
+	ln, err := net.Listen("tcp", p.cfg.Listen)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.ln = ln
+	p.mu.Unlock()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		p.track(conn, true)
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			defer p.track(conn, false)
+			p.handle(conn)
+		}()
+	}
+}
+
+func (p *TCPProxy) track(conn net.Conn, add bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if add {
+		p.conns[conn] = struct{}{}
+	} else {
+		delete(p.conns, conn)
+	}
+}
+
+// Shutdown stops accepting connections and waits for open ones to finish
+// until ctx is done, at which point they are closed.
+func (p *TCPProxy) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	if p.ln != nil {
+		_ = p.ln.Close()
+	}
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	p.mu.Lock()
+	for conn := range p.conns {
+		_ = conn.Close()
+	}
+	p.mu.Unlock()
+	<-done
+	return ctx.Err()
+}
+
+func (p *TCPProxy) handle(client net.Conn) {
+	defer client.Close()
+	p.metrics.requests.Inc()
+	pool := p.router.Pool(p.cfg.Pool)
+	if pool == nil {
+		slog.Error("tcp proxy pool not found", "listen", p.cfg.Listen, "pool", p.cfg.Pool)
+		return
+	}
+	// Algorithms pick backends for HTTP requests; a bare request carrying
+	// the client address lets the address-based ones work for TCP too.
+	r := &http.Request{RemoteAddr: client.RemoteAddr().String(), Header: http.Header{}}
+
+	for attempt := 0; attempt <= pool.RetryPolicy().MaxAttempts; attempt++ {
+		b := pool.acquirePeer(r)
+		if b == nil {
+			break
+		}
+		network, addr := dialAddr(b.url)
+		upstream, err := net.DialTimeout(network, addr, p.cfg.DialTimeout)
+		// The dial outcome settles the breaker, including a half-open
+		// probe the pick may have taken.
+		if err != nil {
+			b.release()
+			slog.Warn("tcp proxy dial failed", "pool", pool.name, "backend", b.url.String(), "remote_addr", r.RemoteAddr, "error", err)
+			pool.stats().failedForwards.WithLabelValues(b.url.String()).Inc()
+			if b.recordFailure(pool.PassiveHealthCheck()) {
+				slog.Warn("passive health check marked backend down", "backend", b.url.String(), "failures", b.consecutiveFailures())
+				b.SetAlive(false)
+			}
+			if b.circuit.failure(pool.CircuitBreaker()) {
+				slog.Warn("circuit breaker opened", "backend", b.url.String())
+			}
+			// The next attempt goes to a backend not dialled yet.
+			r = r.WithContext(withTried(r.Context(), b))
+			continue
+		}
+		b.resetFailures()
+		if b.circuit.success() {
+			slog.Info("circuit breaker closed", "backend", b.url.String())
+		}
+		pool.stats().backendRequests.WithLabelValues(b.url.String()).Inc()
+		slog.Info("forwarding connection", "remote_addr", r.RemoteAddr, "pool", pool.name, "backend", b.url.String(), "attempt", attempt)
+		splice(client, upstream)
+		b.release()
+		return
+	}
+	slog.Warn("no backend available for tcp connection", "pool", pool.name, "remote_addr", r.RemoteAddr)
+}
+
+// splice copies bytes in both directions until both sides are done. When one
+// side finishes sending, the write half towards the other side is closed so
+// protocols relying on half-close keep working.
+func splice(client, upstream net.Conn) {
+	defer upstream.Close()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	pipe := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, _ = io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		} else {
+			_ = dst.Close()
+		}
+	}
+	go pipe(upstream, client)
+	go pipe(client, upstream)
+	wg.Wait()
+}
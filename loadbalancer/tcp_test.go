@@ -0,0 +1,95 @@
+package loadbalancer
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// echoTCP starts a TCP server that echoes every connection back.
+func echoTCP(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln
+}
+
+// refusedAddr returns a local address nothing listens on.
+func refusedAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// proxyTCP sends msg through p over an in-memory connection and returns what
+// comes back.
+func proxyTCP(t *testing.T, p *TCPProxy, msg string) string {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	go p.handle(server)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(client, msg); err != nil {
+		t.Fatalf("writing to the proxy: %v", err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatalf("reading from the proxy: %v", err)
+	}
+	return string(buf)
+}
+
+func TestTCPProxyDialFailure(t *testing.T) {
+	live := echoTCP(t)
+	dead := refusedAddr(t)
+	lb, _ := newTestLB(t, []string{"tcp://" + dead, "tcp://" + live.Addr().String()}, func(c *Config) {
+		c.CircuitBreaker.MaxFailures = 1
+	})
+	p := lb.TCPProxy(TCPProxyConfig{Pool: defaultPoolName})
+	// Round-robin sends one of the two connections to the dead backend
+	// first.
+	for i := 0; i < 2; i++ {
+		if got := proxyTCP(t, p, "hello"); got != "hello" {
+			t.Fatalf("connection %d: echo = %q, want %q", i, got, "hello")
+		}
+	}
+	b := lb.router.Pool(defaultPoolName).Backends()[0]
+	if b.circuit.State() != breakerOpen {
+		t.Fatalf("breaker on %s is %v after a failed dial, want open", b.url, b.circuit.State())
+	}
+}
+
+func TestTCPProxyDialsEachBackendOnce(t *testing.T) {
+	lb, _ := newTestLB(t, []string{"tcp://" + refusedAddr(t)}, func(c *Config) {
+		c.CircuitBreaker.MaxFailures = 0
+		c.PassiveHealthCheck.MaxFailures = 100
+	})
+	p := lb.TCPProxy(TCPProxyConfig{Pool: defaultPoolName})
+	client, server := net.Pipe()
+	client.Close()
+	p.handle(server)
+
+	b := lb.router.Pool(defaultPoolName).Backends()[0]
+	if n := b.consecutiveFailures(); n != 1 {
+		t.Fatalf("the only backend was dialled %d times for one connection, want once", n)
+	}
+}
@@ -0,0 +1,109 @@
+package loadbalancer
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+)
+
+// TLSConfig enables HTTPS on a listener when CertFile and KeyFile are set.
+// MinVersion is one of "1.0", "1.1", "1.2" or "1.3"; CipherSuites takes
+// names as listed by crypto/tls and only applies up to TLS 1.2.
+type TLSConfig struct {
+	CertFile     string   `yaml:"cert_file"`
+	KeyFile      string   `yaml:"key_file"`
+	MinVersion   string   `yaml:"min_version"`
+	CipherSuites []string `yaml:"cipher_suites"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+func (c TLSConfig) validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if c.CertFile == "" || c.KeyFile == "" {
+		return fmt.Errorf("cert_file and key_file must be set together")
+	}
+	for _, f := range []string{c.CertFile, c.KeyFile} {
+		if _, err := os.Stat(f); err != nil {
+			return err
+		}
+	}
+	if _, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile); err != nil {
+		return err
+	}
+	_, err := c.build()
+	return err
+}
+
+func (c TLSConfig) build() (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.MinVersion != "" {
+		v, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown min_version %q, want 1.0, 1.1, 1.2 or 1.3", c.MinVersion)
+		}
+		cfg.MinVersion = v
+	}
+	if len(c.CipherSuites) > 0 {
+		byName := make(map[string]uint16)
+		for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			byName[cs.Name] = cs.ID
+		}
+		for _, name := range c.CipherSuites {
+			id, ok := byName[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown cipher suite %q", name)
+			}
+			cfg.CipherSuites = append(cfg.CipherSuites, id)
+		}
+	}
+	return cfg, nil
+}
+
+// ListenAndServe starts srv over HTTPS when c is enabled and plain HTTP
+// otherwise.
+func ListenAndServe(srv *http.Server, c TLSConfig) error {
+	return ListenerConfig{Listen: srv.Addr, TLS: c}.ListenAndServe(srv)
+}
+
+// ListenAndServe starts srv on l's address, over HTTPS when l's TLS is
+// enabled, reading a PROXY protocol header from every connection when
+// l.ProxyProtocol is set.
+func (l ListenerConfig) ListenAndServe(srv *http.Server) error {
+	var tlsCfg *tls.Config
+	if l.TLS.Enabled() {
+		var err error
+		if tlsCfg, err = l.TLS.build(); err != nil {
+			return err
+		}
+	}
+	addr := l.Listen
+	if addr == "" {
+		addr = ":http"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if l.ProxyProtocol {
+		ln = proxyListener{ln}
+	}
+	if tlsCfg == nil {
+		return srv.Serve(ln)
+	}
+	srv.TLSConfig = tlsCfg
+	return srv.ServeTLS(ln, l.TLS.CertFile, l.TLS.KeyFile)
+}
@@ -0,0 +1,129 @@
+package loadbalancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// TracingConfig exports an OpenTelemetry span per proxied request to an
+// OTLP/HTTP collector.
+type TracingConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Endpoint is the collector's host:port, e.g. localhost:4318.
+	Endpoint string `yaml:"endpoint"`
+	// Insecure sends spans over plain HTTP instead of HTTPS.
+	Insecure    bool   `yaml:"insecure"`
+	ServiceName string `yaml:"service_name"`
+	// SampleRatio is the share of new traces that are recorded. Requests
+	// that are part of a trace follow the caller's sampling decision.
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+func (c TracingConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Endpoint == "" {
+		return errors.New("endpoint is required")
+	}
+	if c.SampleRatio < 0 || c.SampleRatio > 1 {
+		return fmt.Errorf("sample_ratio must be between 0 and 1, got %g", c.SampleRatio)
+	}
+	return nil
+}
+
+// propagator reads the trace context of incoming requests and writes it to
+// upstream requests.
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// newTracerProvider returns the provider spans are created from. When
+// tracing is disabled it records nothing and the returned provider is nil.
+func newTracerProvider(cfg TracingConfig) (trace.Tracer, *sdktrace.TracerProvider, error) {
+	if !cfg.Enabled {
+		return noop.NewTracerProvider().Tracer(""), nil, nil
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+	if cfg.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", cfg.ServiceName))),
+	)
+	return tp.Tracer("github.com/sidkhuntia/goloadbalancer"), tp, nil
+}
+
+// tracing starts a server span for each request, continuing the trace the
+// client sent, if any.
+func tracing(next http.Handler, tracer trace.Tracer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, "proxy "+r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+				attribute.String("server.address", r.Host),
+				attribute.String("client.address", clientIP(r, false)),
+			),
+		)
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", rec.status))
+		if rec.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
+
+// traceAttempt records on the request's span which backend an attempt went
+// to. Attempts after the first are recorded as failover events.
+func traceAttempt(r *http.Request, pool string, backend *Backend, attempt int) {
+	span := trace.SpanFromContext(r.Context())
+	if !span.IsRecording() {
+		return
+	}
+	attrs := []attribute.KeyValue{
+		attribute.String("lb.pool", pool),
+		attribute.String("lb.backend", backend.url.String()),
+		attribute.Int("lb.attempt", attempt),
+	}
+	if attempt > 0 {
+		span.AddEvent("failover", trace.WithAttributes(attrs...))
+	}
+	span.SetAttributes(attrs...)
+}
+
+// traceRetry records a retry against the same backend as a span event.
+func traceRetry(r *http.Request, backend *Backend, retry int, err error) {
+	span := trace.SpanFromContext(r.Context())
+	if !span.IsRecording() {
+		return
+	}
+	span.AddEvent("retry", trace.WithAttributes(
+		attribute.String("lb.backend", backend.url.String()),
+		attribute.Int("lb.retry", retry),
+		attribute.String("error", err.Error()),
+	))
+}
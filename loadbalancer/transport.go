@@ -0,0 +1,129 @@
+package loadbalancer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// UpstreamTLSConfig controls how the load balancer verifies HTTPS backends.
+// CAFile adds a PEM bundle of trusted roots on top of the system pool,
+// ServerName overrides the name checked against the backend certificate and
+// CertFile/KeyFile present a client certificate for mutual TLS.
+type UpstreamTLSConfig struct {
+	CAFile             string `yaml:"ca_file"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	ServerName         string `yaml:"server_name"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+}
+
+func (c UpstreamTLSConfig) build() (*tls.Config, error) {
+	cfg := &tls.Config{
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		ServerName:         c.ServerName,
+	}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+		cfg.RootCAs = pool
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// TransportConfig sizes the connection pool to the backends and bounds how
+// long connecting may take. The defaults are those of http.DefaultTransport.
+// Zero limits mean no limit, as in http.Transport.
+type TransportConfig struct {
+	MaxIdleConns        int           `yaml:"max_idle_conns"`
+	MaxIdleConnsPerHost int           `yaml:"max_idle_conns_per_host"`
+	MaxConnsPerHost     int           `yaml:"max_conns_per_host"`
+	IdleConnTimeout     time.Duration `yaml:"idle_conn_timeout"`
+	DialTimeout         time.Duration `yaml:"dial_timeout"`
+	KeepAlive           time.Duration `yaml:"keep_alive"`
+	TLSHandshakeTimeout time.Duration `yaml:"tls_handshake_timeout"`
+}
+
+func defaultTransportConfig() TransportConfig {
+	return TransportConfig{
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: http.DefaultMaxIdleConnsPerHost,
+		IdleConnTimeout:     90 * time.Second,
+		DialTimeout:         30 * time.Second,
+		KeepAlive:           30 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+}
+
+func (c TransportConfig) validate() error {
+	if c.MaxIdleConns < 0 || c.MaxIdleConnsPerHost < 0 || c.MaxConnsPerHost < 0 {
+		return fmt.Errorf("connection limits must not be negative")
+	}
+	if c.IdleConnTimeout < 0 || c.DialTimeout < 0 || c.KeepAlive < 0 || c.TLSHandshakeTimeout < 0 {
+		return fmt.Errorf("timeouts must not be negative")
+	}
+	return nil
+}
+
+// newTransport builds a transport with the given pool settings and upstream
+// TLS settings.
+func newTransport(tc TransportConfig, c UpstreamTLSConfig) (*http.Transport, error) {
+	tlsCfg, err := c.build()
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{
+		Timeout:   tc.DialTimeout,
+		KeepAlive: tc.KeepAlive,
+	}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          tc.MaxIdleConns,
+		MaxIdleConnsPerHost:   tc.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       tc.MaxConnsPerHost,
+		IdleConnTimeout:       tc.IdleConnTimeout,
+		TLSHandshakeTimeout:   tc.TLSHandshakeTimeout,
+		ExpectContinueTimeout: time.Second,
+		TLSClientConfig:       tlsCfg,
+	}, nil
+}
+
+// schemeUnix is the URL scheme of backends listening on a unix socket.
+const schemeUnix = "unix"
+
+// dialAddr returns the network and address to dial to reach u.
+func dialAddr(u *url.URL) (network, address string) {
+	if u.Scheme == schemeUnix {
+		return "unix", u.Path
+	}
+	return "tcp", u.Host
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
@@ -0,0 +1,55 @@
+package loadbalancer
+
+import (
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// Version is the release the binary was built as. It is set at link time
+// with -ldflags "-X github.com/sidkhuntia/goloadbalancer/loadbalancer.Version=v1.2.3";
+// when empty, the module version from the build info is used.
+var Version string
+
+// startTime approximates the process start, for uptime.
+var startTime = time.Now()
+
+type versionResponse struct {
+	Version   string    `json:"version"`
+	Commit    string    `json:"commit,omitempty"`
+	CommitAt  string    `json:"commit_time,omitempty"`
+	Modified  bool      `json:"modified,omitempty"`
+	GoVersion string    `json:"go_version"`
+	StartedAt time.Time `json:"started_at"`
+	Uptime    string    `json:"uptime"`
+}
+
+func buildVersion() versionResponse {
+	v := versionResponse{
+		Version:   Version,
+		GoVersion: runtime.Version(),
+		StartedAt: startTime,
+		Uptime:    time.Since(startTime).Round(time.Second).String(),
+	}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		if v.Version == "" {
+			v.Version = "unknown"
+		}
+		return v
+	}
+	if v.Version == "" {
+		v.Version = bi.Main.Version
+	}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			v.Commit = s.Value
+		case "vcs.time":
+			v.CommitAt = s.Value
+		case "vcs.modified":
+			v.Modified = s.Value == "true"
+		}
+	}
+	return v
+}
@@ -0,0 +1,87 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// Spillover triggers for zone-aware balancing.
+const (
+	// SpilloverDown sends traffic to other zones only once no local
+	// backend is up.
+	SpilloverDown = "down"
+	// SpilloverCapacity also spills over while every local backend that is
+	// up is at its max_conns cap or otherwise unable to take a request.
+	SpilloverCapacity = "capacity"
+)
+
+// LocalityConfig tells the zone-aware algorithm where the load balancer
+// runs. Backends whose Key tag equals Zone are local.
+type LocalityConfig struct {
+	Key       string `yaml:"key"`
+	Zone      string `yaml:"zone"`
+	Spillover string `yaml:"spillover"`
+}
+
+func (c LocalityConfig) validate() error {
+	if c.Key == "" {
+		return fmt.Errorf("key is required")
+	}
+	switch c.Spillover {
+	case SpilloverDown, SpilloverCapacity:
+	default:
+		return fmt.Errorf("unknown spillover %q, want %q or %q", c.Spillover, SpilloverDown, SpilloverCapacity)
+	}
+	return nil
+}
+
+// ZoneAware round-robins over the backends in the load balancer's own zone
+// and only uses backends elsewhere when the local ones cannot serve, as set
+// by the locality's spillover trigger. Without a locality every backend is
+// local.
+type ZoneAware struct {
+	locality atomic.Pointer[LocalityConfig]
+	current  uint64
+}
+
+// SetLocality changes the zone the algorithm prefers.
+func (z *ZoneAware) SetLocality(c LocalityConfig) {
+	z.locality.Store(&c)
+}
+
+func (z *ZoneAware) Pick(pool *ServerPool, r *http.Request) *Backend {
+	loc := z.locality.Load()
+	var local, remote []*Backend
+	// localUp is whether a local backend of the active tier is up but
+	// unable to take the request; standby tiers do not count.
+	localUp := false
+	tier := pool.ActiveTier()
+	for _, b := range pool.Backends() {
+		isLocal := loc == nil || b.Tag(loc.Key) == loc.Zone
+		if !pool.IsAvailable(b) {
+			if isLocal && b.IsAlive() && !b.IsDraining() && b.Priority() == tier {
+				localUp = true
+			}
+			continue
+		}
+		if isLocal {
+			local = append(local, b)
+		} else {
+			remote = append(remote, b)
+		}
+	}
+	candidates := local
+	if len(candidates) == 0 {
+		if localUp && loc != nil && loc.Spillover == SpilloverDown {
+			// The local backends are busy, not down; the request waits for
+			// them rather than crossing zones.
+			return nil
+		}
+		candidates = remote
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[atomic.AddUint64(&z.current, 1)%uint64(len(candidates))]
+}
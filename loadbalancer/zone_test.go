@@ -0,0 +1,42 @@
+package loadbalancer
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestZoneAwareWithoutLocality(t *testing.T) {
+	pool := newTestPool(t, "zone-aware", 2)
+	cb := CircuitBreaker{MaxFailures: 1, Cooldown: time.Minute}
+	pool.SetCircuitBreaker(cb)
+	backends := pool.Backends()
+	backends[0].circuit.failure(cb)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	for i := 0; i < 4; i++ {
+		if got := pool.GetNextPeer(r); got != backends[1] {
+			t.Fatalf("picked %v, want the backend whose breaker is closed", got)
+		}
+	}
+	backends[1].circuit.failure(cb)
+	if got := pool.GetNextPeer(r); got != nil {
+		t.Fatalf("picked %s with every breaker open", got.url)
+	}
+}
+
+func TestZoneAwareIgnoresLocalStandbys(t *testing.T) {
+	pool := newTestPool(t, "zone-aware", 2)
+	pool.Algorithm().(*ZoneAware).SetLocality(LocalityConfig{Key: "zone", Zone: "a", Spillover: SpilloverDown})
+	backends := pool.Backends()
+	standby, remote := backends[0], backends[1]
+	standby.SetTags(map[string]string{"zone": "a"})
+	standby.SetPriority(1)
+	remote.SetTags(map[string]string{"zone": "b"})
+
+	// The local backend is up but only a standby, so the remote one of the
+	// active tier takes the traffic.
+	if got := pool.GetNextPeer(httptest.NewRequest("GET", "/", nil)); got != remote {
+		t.Fatalf("picked %v, want the remote backend of the active tier", got)
+	}
+}
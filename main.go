@@ -2,202 +2,218 @@ package main
 
 import (
 	"context"
-	"log"
-	"net"
+	"flag"
+	"fmt"
+	"log/slog"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
+	"os"
+	"os/signal"
+	"strings"
 	"sync"
-	"sync/atomic"
+	"syscall"
 	"time"
-)
 
-const (
-	Attempts int = iota
-	Retry
+	"github.com/sidkhuntia/goloadbalancer/loadbalancer"
 )
 
-type Backend struct {
-	url     *url.URL
-	proxy   *httputil.ReverseProxy
-	isAlive bool
-	mux     sync.RWMutex
-}
-
-func (b *Backend) SetAlive(alive bool) {
-	b.mux.Lock()
-	b.isAlive = alive
-	b.mux.Unlock()
-}
-
-func (b *Backend) IsAlive() (alive bool) {
-	b.mux.RLock()
-	alive = b.isAlive
-	b.mux.RUnlock()
-	return
-}
-
-type ServerPool struct {
-	backends []*Backend
-	current  uint64
-}
-
-func (s *ServerPool) AddBackend(backend *Backend) {
-	s.backends = append(s.backends, backend)
-}
-
-func (s *ServerPool) NextIndex() int {
-	return int(atomic.AddUint64(&s.current, uint64(1)) % uint64(len(s.backends)))
-}
-
-func (s *ServerPool) GetNextPeer() *Backend {
-	next := s.NextIndex()
-	l := len(s.backends) + next
-
-	for i := next; i < l; i++ {
-		idx := i % len(s.backends)
+func main() {
+	configPath := flag.String("config", "", "path to a YAML config file")
+	listenAddr := flag.String("listen", ":8080", "address the load balancer listens on")
+	algorithm := flag.String("algorithm", "round-robin", "balancing algorithm: "+strings.Join(loadbalancer.AlgorithmNames(), ", "))
+	redirectAddr := flag.String("redirect-http-from", "", "address of a plaintext listener redirecting every request to HTTPS, e.g. :80 (disabled when empty)")
+	adminAddr := flag.String("admin-listen", "", "address for the admin API, e.g. 127.0.0.1:9090 (disabled when empty)")
+	healthInterval := flag.Duration("health-interval", 30*time.Second, "interval between active health checks")
+	healthTimeout := flag.Duration("health-timeout", 2*time.Second, "timeout for a single health probe")
+	healthVerbose := flag.Bool("health-verbose", false, "log every health probe instead of only backend state changes")
+	logLevel := flag.String("log-level", "info", "minimum log level: debug, info, warn or error")
+	logFormat := flag.String("log-format", "json", "log output format: json or text")
+	skipStartupCheck := flag.Bool("skip-startup-check", false, "start serving without first health checking every backend once")
+	validateOnly := flag.Bool("validate", false, "check the config and flags, then exit with status 0 if they are valid and 1 if not")
+	flag.Parse()
+
+	if err := setupLogging(*logLevel, *logFormat); err != nil {
+		fatal("invalid logging flags", "error", err)
+	}
 
-		if s.backends[idx].isAlive {
-			if i != next {
-				atomic.StoreUint64(&s.current, uint64(idx))
+	// Flags only override the config file when they are set explicitly.
+	overrides := func(cfg *loadbalancer.Config) {
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "listen":
+				cfg.Listen = *listenAddr
+			case "algorithm":
+				cfg.Algorithm = *algorithm
+			case "redirect-http-from":
+				cfg.RedirectHTTP.Listen = *redirectAddr
+			case "admin-listen":
+				cfg.Admin.Listen = *adminAddr
+			case "health-interval":
+				cfg.HealthInterval = *healthInterval
+			case "health-timeout":
+				cfg.HealthCheck.Timeout = *healthTimeout
+			case "health-verbose":
+				cfg.HealthCheck.Verbose = *healthVerbose
 			}
-			return s.backends[idx]
-		}
+		})
 	}
 
-	return nil
-}
-
-func (s *ServerPool) MarkBackendStatus(url *url.URL, alive bool) {
-	for _, b := range s.backends {
-		if b.url.String() == url.String() {
-			b.SetAlive(alive)
-			break
-		}
+	if *validateOnly {
+		os.Exit(validate(*configPath, overrides))
 	}
-}
 
-func GetRetryFromContext(r *http.Request) int {
-	if retry, ok := r.Context().Value(Retry).(int); ok {
-		return retry
+	cfg, err := loadbalancer.LoadConfig(*configPath, overrides)
+	if err != nil {
+		fatal("invalid config", "error", err)
 	}
-	return 0
-}
-
-func GetAttemptsFromContext(r *http.Request) int {
-	if attempts, ok := r.Context().Value(Attempts).(int); ok {
-		return attempts
+	lb, err := loadbalancer.New(cfg)
+	if err != nil {
+		fatal("invalid config", "error", err)
 	}
-	return 0
-}
 
-func loadBalancer(w http.ResponseWriter, r *http.Request) {
-	attempts := GetAttemptsFromContext(r)
-	if attempts > 3 {
-		log.Printf("%s(%s) Max attempts reached, terminating\n", r.RemoteAddr, r.URL.Path)
-		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
-		return
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if !*skipStartupCheck {
+		slog.Info("checking backends before serving")
+		if alive := lb.CheckHealth(ctx); alive == 0 {
+			slog.Warn("no backend is alive at startup, requests will fail until one comes up")
+		} else {
+			slog.Info("startup health check completed", "alive", alive)
+		}
 	}
-	peer := serverPool.GetNextPeer()
-	if peer != nil {
-		log.Printf("%s(%s) forwarding to %s\n", r.RemoteAddr, r.URL.Path, peer.url)
-		peer.proxy.ServeHTTP(w, r)
-		return
+	lb.Start(ctx)
+
+	if *configPath != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				reloadConfig(lb, *configPath, overrides)
+			}
+		}()
 	}
 
-	http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
-}
-
-func isBackendAlive(url *url.URL) bool {
-	timeout := 2 * time.Second
-	conn, err := net.DialTimeout("tcp", url.Host, timeout)
-	if err != nil {
-		log.Println("Site unreachable, error: ", err)
-		return false
+	var servers []*http.Server
+	for _, l := range cfg.AllListeners() {
+		l := l
+		server := &http.Server{
+			Addr:    l.Listen,
+			Handler: lb,
+		}
+		cfg.ServerTimeouts.Apply(server)
+		servers = append(servers, server)
+		go func() {
+			slog.Info("starting load balancer", "addr", l.Listen, "tls", l.TLS.Enabled(), "proxy_protocol", l.ProxyProtocol)
+			if err := l.ListenAndServe(server); err != nil && err != http.ErrServerClosed {
+				fatal("server failed", "addr", l.Listen, "error", err)
+			}
+		}()
 	}
-	_ = conn.Close()
-	return true
-}
 
-func (s *ServerPool) checkHealth() {
-	for _, b := range s.backends {
-		status := "up"
-		alive := isBackendAlive(b.url)
-		b.SetAlive(alive)
-		if !alive {
-			status = "down"
+	if cfg.RedirectHTTP.Listen != "" {
+		redirect := &http.Server{
+			Addr:    cfg.RedirectHTTP.Listen,
+			Handler: loadbalancer.RedirectHandler(cfg.RedirectPort(), cfg.RedirectHTTP.Status),
 		}
-		log.Printf("%s [%s]\n", b.url, status)
+		cfg.ServerTimeouts.Apply(redirect)
+		servers = append(servers, redirect)
+		go func() {
+			slog.Info("starting https redirect", "addr", redirect.Addr, "port", cfg.RedirectPort(), "status", cfg.RedirectHTTP.Status)
+			if err := redirect.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fatal("https redirect failed", "error", err)
+			}
+		}()
 	}
-}
 
-func healthCheck() {
-	t := time.NewTicker(time.Second * 30)
-	for {
-		select {
-		case <-t.C:
-			log.Println("Starting health check...")
-			serverPool.checkHealth()
-			log.Println("Health check completed")
+	if cfg.Admin.Listen != "" {
+		admin := &http.Server{
+			Addr:    cfg.Admin.Listen,
+			Handler: lb.AdminHandler(),
 		}
+		cfg.ServerTimeouts.Apply(admin)
+		servers = append(servers, admin)
+		go func() {
+			slog.Info("starting admin API", "addr", admin.Addr, "tls", cfg.Admin.TLS.Enabled())
+			if err := loadbalancer.ListenAndServe(admin, cfg.Admin.TLS); err != nil && err != http.ErrServerClosed {
+				fatal("admin API failed", "error", err)
+			}
+		}()
 	}
-}
 
-var serverPool ServerPool
-
-func main() {
-	var serverList = []string{
-		"http://localhost:8081",
-		"http://localhost:8082",
-		"http://localhost:8083",
+	var tcpProxies []*loadbalancer.TCPProxy
+	for _, tc := range cfg.TCP {
+		p := lb.TCPProxy(tc)
+		tcpProxies = append(tcpProxies, p)
+		go func() {
+			slog.Info("starting tcp proxy", "addr", p.Addr(), "pool", p.Pool())
+			if err := p.ListenAndServe(); err != nil {
+				fatal("tcp proxy failed", "addr", p.Addr(), "error", err)
+			}
+		}()
 	}
 
-	for _, server := range serverList {
-		url, err := url.Parse(server)
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		proxy := httputil.NewSingleHostReverseProxy(url)
-		proxy.ErrorHandler = func(writer http.ResponseWriter, request *http.Request, e error) {
-			log.Printf("[%s] %s\n", url.Host, e.Error())
-			retries := GetRetryFromContext(request)
-			if retries < 3 {
-				select {
-				case <-time.After(10 * time.Millisecond):
-					ctx := context.WithValue(request.Context(), Retry, retries+1)
-					proxy.ServeHTTP(writer, request.WithContext(ctx))
-				}
-				return
+	<-ctx.Done()
+	stop()
+	slog.Info("shutting down, draining in-flight requests", "timeout", cfg.ShutdownTimeout)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	// All listeners stop accepting at once and drain under the same deadline.
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				slog.Error("shutdown did not complete", "addr", srv.Addr, "error", err)
 			}
-
-			serverPool.MarkBackendStatus(url, false)
-
-			attemps := GetAttemptsFromContext(request)
-			log.Printf("%s(%s) Attempting retry %d\n", request.RemoteAddr, request.URL.Path, attemps)
-			ctx := context.WithValue(request.Context(), Attempts, attemps+1)
-			loadBalancer(writer, request.WithContext(ctx))
-
+		}(srv)
+	}
+	wg.Wait()
+	for _, p := range tcpProxies {
+		if err := p.Shutdown(shutdownCtx); err != nil {
+			slog.Error("shutdown did not complete", "addr", p.Addr(), "error", err)
 		}
-		serverPool.AddBackend(&Backend{
-			url:     url,
-			proxy:   proxy,
-			isAlive: true,
-		})
-
-		log.Printf("Configured server: %s\n", url)
+	}
+	lb.Stop()
+	slog.Info("shutdown complete")
+}
 
+// validate checks the config file as starting the load balancer would,
+// without listening, health checking or looking up discovered backends, and
+// returns the exit status.
+func validate(path string, override func(*loadbalancer.Config)) int {
+	name := path
+	if name == "" {
+		name = "default config"
 	}
-	server := http.Server{
-		Addr:    ":8080",
-		Handler: http.HandlerFunc(loadBalancer),
+	cfg, err := loadbalancer.LoadConfig(path, override)
+	if err == nil {
+		var lb *loadbalancer.LoadBalancer
+		if lb, err = loadbalancer.New(cfg, loadbalancer.WithoutDiscovery()); err == nil {
+			lb.Stop()
+		}
 	}
-
-	go healthCheck()
-
-	log.Println("Starting load balancer server on port 8080")
-	if err := server.ListenAndServe(); err != nil {
-		log.Fatal(err)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		return 1
 	}
+	fmt.Printf("%s: ok\n", name)
+	return 0
+}
 
+// reloadConfig re-reads the config file and applies it to the running load
+// balancer. An invalid file is logged and ignored so the current
+// configuration stays in effect.
+func reloadConfig(lb *loadbalancer.LoadBalancer, path string, override func(*loadbalancer.Config)) {
+	slog.Info("reloading config", "path", path)
+	cfg, err := loadbalancer.LoadConfig(path, override)
+	if err != nil {
+		slog.Error("config reload failed, keeping current configuration", "error", err)
+		return
+	}
+	if err := lb.Reload(cfg); err != nil {
+		slog.Error("config reload failed", "error", err)
+		return
+	}
+	slog.Info("config reloaded")
 }